@@ -3,10 +3,24 @@ package controllers
 import (
     "github.com/robfig/revel"
     "github.com/justjake/mail/app/models"
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "mime/multipart"
+    "net/http"
+    "net/mail"
+    "strconv"
+    "strings"
+    "time"
 )
 
 const CurrentServerKey = "__CURRENT__"
 
+// messages per page when the client doesn't say
+const DefaultPageSize = 50
+// and the most we'll hand out at once
+const MaxPageSize = 500
+
 type Mailboxes struct {
     *revel.Controller
 }
@@ -18,7 +32,75 @@ type mailboxList struct {
 }
 
 type mailList struct {
-    Messages  []*models.Message
+    Messages  []*models.Email
+    Hostname  string
+    Mailbox   string
+    // pass as ?since= to get only what changed
+    Token     string
+}
+
+type mailPage struct {
+    *models.MessagePage
+    Hostname  string
+    Mailbox   string
+}
+
+type searchResults struct {
+    *models.SearchResult
+    // the newest matches, up to the requested limit
+    Messages  []*models.Email
+    Hostname  string
+    Mailbox   string
+}
+
+type threadPage struct {
+    *models.ThreadPage
+    Hostname  string
+    Mailbox   string
+}
+
+type moveResult struct {
+    Hostname    string
+    Mailbox     string
+    Destination string
+    // old UID -> UID in the destination, if the server told us
+    UIDs        map[string]uint32
+    // token for the source mailbox after the move
+    Token       string
+}
+
+type deleteResult struct {
+    Hostname  string
+    Mailbox   string
+    // POST to /mail/undo/<token> to put the messages back. Empty if the
+    // delete was permanent
+    Undo      string
+    Token     string
+}
+
+type uploadResult struct {
+    Filename  string
+    // 0 if the server didn't say, or the upload failed
+    UID       uint32
+    Error     string `json:",omitempty"`
+}
+
+type uploadResults struct {
+    Uploaded  []*uploadResult
+    Hostname  string
+    Mailbox   string
+}
+
+type messageView struct {
+    *models.Email
+    // the parts of Message to show, and its attachments
+    Display   *models.Display
+    Hostname  string
+    Mailbox   string
+}
+
+type mailDelta struct {
+    *models.MailboxDelta
     Hostname  string
     Mailbox   string
 }
@@ -40,6 +122,12 @@ func (c Mailboxes) getCurrentServer() (*models.Server, revel.Result) {
     return current_server, nil
 }
 
+// a 400, for parameters we can't make sense of
+func (c Mailboxes) badRequest(err error) revel.Result {
+    c.Response.Status = http.StatusBadRequest
+    return c.RenderError(err)
+}
+
 // list mailboxes on the current server
 func (c Mailboxes) Index() revel.Result {
 
@@ -57,31 +145,438 @@ func (c Mailboxes) Index() revel.Result {
     return c.RenderJson(res)
 }
 
-func (c Mailboxes) Messages(box string) revel.Result {
+// list the messages in a mailbox, newest first, a page at a time.
+// ?limit=50&before=<uid> gets the page of messages older than <uid>.
+// ?sort=date|arrival|from|subject|size orders the list instead, reversed
+// with &reverse=true, and ?thread=true groups it into conversations.
+// with ?since=<token>, only what changed after that token is returned
+func (c Mailboxes) Messages(box, since string, limit int, before uint32,
+                            sort string, reverse, thread bool) revel.Result {
 
     // get the current server that we will look for the mailbox in
     current_server, redirect := c.getCurrentServer()
     if redirect != nil { return redirect }
 
-    // create mailbox here
-    mbox := models.NewMailbox(box, current_server)
+    // reuse the mailbox (and its cache) if we have one
+    mbox := current_server.Mailbox(box)
+
+    if since != "" {
+        // try an upper-date this hur mailbox
+        _, err := mbox.Update()
+        if err != nil {
+            return c.RenderError(err)
+        }
 
-    // try an upper-date this hur mailbox
-    messages, err := mbox.Update()
+        delta := mbox.Changes(since)
+        return c.RenderJson(&mailDelta{delta, current_server.Hostname, box})
+    }
+
+    if limit <= 0 {
+        limit = DefaultPageSize
+    } else if limit > MaxPageSize {
+        limit = MaxPageSize
+    }
+
+    if thread {
+        threads, err := mbox.Threads(nil)
+        if err != nil {
+            return c.RenderError(err)
+        }
+        // newest conversations first, unless asked otherwise
+        if !reverse {
+            for i, j := 0, len(threads) - 1; i < j; i, j = i + 1, j - 1 {
+                threads[i], threads[j] = threads[j], threads[i]
+            }
+        }
+        page, err := mbox.ThreadPage(threads, limit, before)
+        if err != nil {
+            return c.RenderError(err)
+        }
+        return c.RenderJson(&threadPage{page, current_server.Hostname, box})
+    }
+
+    var page *models.MessagePage
+    var err error
+    if sort != "" {
+        var key models.SortKey
+        var uids []uint32
+        if key, err = models.ParseSortKey(sort); err != nil {
+            return c.RenderError(err)
+        }
+        if uids, err = mbox.Sort(key, reverse, nil); err != nil {
+            return c.RenderError(err)
+        }
+        page, err = mbox.PageOf(uids, limit, before)
+    } else {
+        page, err = mbox.Page(limit, before)
+    }
     if err != nil {
         return c.RenderError(err)
     }
 
-    // store the mailbox, for old time's sake
-    current_server.Mailboxes[box] = mbox
-
     // return our beautiful json results
-    result := &mailList{messages, current_server.Hostname, box}
-    return c.RenderJson(result)
+    return c.RenderJson(&mailPage{page, current_server.Hostname, box})
+}
+
+// search a mailbox on the server. Every given parameter must match:
+// from, to, subject, body, text, since and before (YYYY-MM-DD), seen and
+// flagged ("true" or "false"), keyword, larger and smaller (bytes), and
+// uids (comma-seperated). Returns all matching UIDs, plus the newest
+// `limit` matching messages.
+func (c Mailboxes) Search(box string, limit int) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    criteria, err := c.searchCriteria()
+    if err != nil {
+        return c.badRequest(err)
+    }
+
+    mbox := current_server.Mailbox(box)
+    result, err := mbox.Search(criteria)
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    if limit <= 0 {
+        limit = DefaultPageSize
+    } else if limit > MaxPageSize {
+        limit = MaxPageSize
+    }
+
+    // newest matches first
+    newest := make([]uint32, 0, limit)
+    for i := len(result.UIDs) - 1; i >= 0 && len(newest) < limit; i-- {
+        newest = append(newest, result.UIDs[i])
+    }
+    messages, err := mbox.Emails(newest)
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    return c.RenderJson(&searchResults{result, messages, current_server.Hostname, box})
+}
+
+// build search criteria out of the request parameters
+func (c Mailboxes) searchCriteria() (*models.Criteria, error) {
+    criteria := models.NewCriteria()
+    params := c.Params.Values
+
+    text := map[string]func(string) *models.Criteria{
+        "from":    criteria.From,
+        "to":      criteria.To,
+        "subject": criteria.Subject,
+        "body":    criteria.Body,
+        "text":    criteria.Text,
+    }
+    for name, add := range text {
+        if value := params.Get(name); value != "" {
+            add(value)
+        }
+    }
+
+    dates := map[string]func(time.Time) *models.Criteria{
+        "since":  criteria.Since,
+        "before": criteria.Before,
+    }
+    for name, add := range dates {
+        if value := params.Get(name); value != "" {
+            day, err := time.Parse("2006-01-02", value)
+            if err != nil {
+                return nil, fmt.Errorf("bad date for %s: %q", name, value)
+            }
+            add(day)
+        }
+    }
+
+    flags := map[string]string{
+        "seen":     models.FlagSeen,
+        "flagged":  models.FlagFlagged,
+        "answered": models.FlagAnswered,
+    }
+    for name, flag := range flags {
+        switch params.Get(name) {
+        case "":
+        case "true":
+            criteria.Flag(flag)
+        case "false":
+            criteria.NoFlag(flag)
+        default:
+            return nil, fmt.Errorf("%s must be true or false", name)
+        }
+    }
+    if keyword := params.Get("keyword"); keyword != "" {
+        if err := criteria.Flag(keyword).Err(); err != nil { return nil, err }
+    }
+
+    sizes := map[string]func(uint32) *models.Criteria{
+        "larger":  criteria.Larger,
+        "smaller": criteria.Smaller,
+    }
+    for name, add := range sizes {
+        if value := params.Get(name); value != "" {
+            n, err := strconv.ParseUint(value, 10, 32)
+            if err != nil {
+                return nil, fmt.Errorf("bad size for %s: %q", name, value)
+            }
+            add(uint32(n))
+        }
+    }
+
+    if value := params.Get("uids"); value != "" {
+        uids, err := parseUIDs(value)
+        if err != nil { return nil, err }
+        criteria.UIDs(uids...)
+    }
+
+    return criteria, nil
+}
+
+// show one message: its summary, and its MIME tree with the text parts
+// filled in. Attachments are left out; fetch them by section. Display
+// says which parts to show, and has their text rendered as safe HTML, or
+// as plain text if ?plain=true.
+func (c Mailboxes) ShowMessage(box string, message uint32, plain bool) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    mbox := current_server.Mailbox(box)
+    emails, err := mbox.Emails([]uint32{message})
+    if err != nil {
+        return c.RenderError(err)
+    }
+    if len(emails) == 0 {
+        return c.NotFound("No message %d in %s", message, box)
+    }
+
+    email := emails[0]
+    root, err := email.LoadText()
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    return c.RenderJson(&messageView{email, root.DisplayParts(!plain), current_server.Hostname, box})
 }
 
-func (c Mailboxes) ShowMessage(box string, uuid uint32) revel.Result {
-    // TODO: finish
-    return c.Render()
+// flag changes behind the /mark/:action routes
+type markAction struct {
+    add  bool
+    flag string
 }
 
+var markActions = map[string]markAction{
+    "read":       {true,  models.FlagSeen},
+    "unread":     {false, models.FlagSeen},
+    "flagged":    {true,  models.FlagFlagged},
+    "unflagged":  {false, models.FlagFlagged},
+    "answered":   {true,  models.FlagAnswered},
+    "unanswered": {false, models.FlagAnswered},
+}
+
+// parse a comma-seperated list of UIDs like "4,8,15"
+func parseUIDs(list string) ([]uint32, error) {
+    uids := make([]uint32, 0)
+    for _, s := range strings.Split(list, ",") {
+        s = strings.TrimSpace(s)
+        if s == "" { continue }
+        uid, err := strconv.ParseUint(s, 10, 32)
+        if err != nil || uid == 0 {
+            return nil, fmt.Errorf("bad message UID %q", s)
+        }
+        uids = append(uids, uint32(uid))
+    }
+    if len(uids) == 0 {
+        return nil, fmt.Errorf("no messages given")
+    }
+    return uids, nil
+}
+
+// mark a list of messages (?uids=1,2,3) read, unread, flagged, etc.
+func (c Mailboxes) Mark(box, action, uids string) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    list, err := parseUIDs(uids)
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    return c.mark(current_server.Mailbox(box), action, list)
+}
+
+// mark a single message read, unread, flagged, etc.
+func (c Mailboxes) MarkMessage(box string, message uint32, action string) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    return c.mark(current_server.Mailbox(box), action, []uint32{message})
+}
+
+// apply a mark action and return the updated messages
+func (c Mailboxes) mark(mbox *models.Mailbox, action string, uids []uint32) revel.Result {
+    todo, ok := markActions[action]
+    if !ok {
+        return c.NotFound("Unknown action %s", action)
+    }
+
+    var err error
+    if todo.add {
+        err = mbox.AddFlags(uids, todo.flag)
+    } else {
+        err = mbox.RemoveFlags(uids, todo.flag)
+    }
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    // whatever we have cached now has the new flags
+    changed := make([]*models.Email, 0, len(uids))
+    for _, uid := range uids {
+        if email, ok := mbox.Mail[uid]; ok {
+            changed = append(changed, email)
+        }
+    }
+    return c.RenderJson(&mailList{changed, mbox.Server().Hostname, mbox.Name, mbox.Token()})
+}
+
+// move a list of messages (?uids=1,2,3) to another mailbox (?to=name)
+func (c Mailboxes) Move(box, to, uids string) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    if to == "" {
+        return c.RenderError(fmt.Errorf("no destination mailbox given"))
+    }
+
+    return c.move(current_server.Mailbox(box), current_server.Mailbox(to), uids)
+}
+
+// move a list of messages (?uids=1,2,3) to the server's archive mailbox
+func (c Mailboxes) Archive(box, uids string) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    archive, err := current_server.SpecialMailbox(models.SpecialArchive)
+    if err != nil {
+        return c.RenderError(err)
+    }
+    if archive == nil {
+        return c.NotFound("%s has no archive mailbox", current_server.Hostname)
+    }
+
+    return c.move(current_server.Mailbox(box), archive, uids)
+}
+
+// move messages and report where they ended up
+func (c Mailboxes) move(mbox, dest *models.Mailbox, uids string) revel.Result {
+    list, err := parseUIDs(uids)
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    moved, err := mbox.MoveTo(list, dest)
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    // JSON object keys have to be strings
+    newUIDs := make(map[string]uint32, len(moved))
+    for old, uid := range moved {
+        newUIDs[strconv.FormatUint(uint64(old), 10)] = uid
+    }
+
+    return c.RenderJson(&moveResult{
+        Hostname:    mbox.Server().Hostname,
+        Mailbox:     mbox.Name,
+        Destination: dest.Name,
+        UIDs:        newUIDs,
+        Token:       mbox.Token(),
+    })
+}
+
+// delete a list of messages (?uids=1,2,3), moving them to the Trash
+func (c Mailboxes) Delete(box, uids string) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    list, err := parseUIDs(uids)
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    mbox := current_server.Mailbox(box)
+    undo, err := mbox.Delete(list)
+    if err != nil {
+        return c.RenderError(err)
+    }
+
+    return c.RenderJson(&deleteResult{current_server.Hostname, box, undo, mbox.Token()})
+}
+
+// put back the messages from a delete
+func (c Mailboxes) Undo(token string) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    mbox, err := current_server.Undo(token)
+    if err != nil {
+        return c.NotFound("%v", err)
+    }
+
+    return c.RenderJson(&deleteResult{current_server.Hostname, mbox.Name, "", mbox.Token()})
+}
+
+// store uploaded .eml files in a mailbox. Every file in the multipart form
+// is stored, with the flags from ?flags=\Seen,\Flagged and its Date header
+// as the arrival time.
+func (c Mailboxes) Upload(box, flags string) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    flagList := make([]string, 0)
+    for _, flag := range strings.Split(flags, ",") {
+        if flag = strings.TrimSpace(flag); flag != "" {
+            flagList = append(flagList, flag)
+        }
+    }
+
+    mbox := current_server.Mailbox(box)
+    results := make([]*uploadResult, 0)
+    for _, files := range c.Params.Files {
+        for _, header := range files {
+            result := &uploadResult{Filename: header.Filename}
+            results = append(results, result)
+
+            raw, err := readUpload(header)
+            if err == nil {
+                result.UID, err = mbox.Append(bytes.NewReader(raw), flagList, messageDate(raw))
+            }
+            if err != nil {
+                result.Error = err.Error()
+            }
+        }
+    }
+
+    if len(results) == 0 {
+        return c.RenderError(fmt.Errorf("no files uploaded"))
+    }
+
+    return c.RenderJson(&uploadResults{results, current_server.Hostname, box})
+}
+
+// read an uploaded file into memory
+func readUpload(header *multipart.FileHeader) ([]byte, error) {
+    file, err := header.Open()
+    if err != nil { return nil, err }
+    defer file.Close()
+    return ioutil.ReadAll(file)
+}
+
+// the Date header of a raw message, or the zero time
+func messageDate(raw []byte) time.Time {
+    msg, err := mail.ReadMessage(bytes.NewReader(raw))
+    if err != nil { return time.Time{} }
+    date, err := msg.Header.Date()
+    if err != nil { return time.Time{} }
+    return date
+}
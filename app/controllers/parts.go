@@ -0,0 +1,101 @@
+package controllers
+
+import (
+    "github.com/robfig/revel"
+    "github.com/justjake/mail/app/models"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// a decoded MIME part, served with http.ServeContent so browsers get a
+// Content-Length and can resume big downloads with Range requests
+type partResult struct {
+    content     io.ReadSeeker
+    contentType string
+    // "inline" or "attachment"
+    disposition string
+    filename    string
+    modified    time.Time
+}
+
+func (r *partResult) Apply(req *revel.Request, resp *revel.Response) {
+    header := resp.Out.Header()
+    header.Set("Content-Type", r.contentType)
+    // don't let the browser decide a download is really HTML
+    header.Set("X-Content-Type-Options", "nosniff")
+
+    disposition := mime.FormatMediaType(r.disposition, map[string]string{"filename": r.filename})
+    if disposition == "" {
+        disposition = r.disposition
+    }
+    header.Set("Content-Disposition", disposition)
+
+    http.ServeContent(resp.Out, req.Request, r.filename, r.modified, r.content)
+    if closer, ok := r.content.(io.Closer); ok {
+        closer.Close()
+    }
+}
+
+// stream one part of a message (GET /mail/:box/:message/parts/1.2),
+// decoded. Only that part is fetched from the server, and a big one a chunk
+// at a time, so it's never held in memory whole. Images are shown in
+// the browser; everything else is downloaded, so a hostile part can't run
+// as our page.
+func (c Mailboxes) Part(box string, message uint32, section string) revel.Result {
+    current_server, redirect := c.getCurrentServer()
+    if redirect != nil { return redirect }
+
+    emails, err := current_server.Mailbox(box).Emails([]uint32{message})
+    if err != nil {
+        return c.RenderError(err)
+    }
+    if len(emails) == 0 {
+        return c.NotFound("No message %d in %s", message, box)
+    }
+    email := emails[0]
+
+    part, content, err := email.PartData(section)
+    if err != nil {
+        return c.NotFound("%v", err)
+    }
+
+    result := &partResult{
+        content:     content,
+        contentType: part.ContentType,
+        disposition: "attachment",
+        filename:    part.Filename,
+    }
+    // SVG can carry scripts
+    if strings.HasPrefix(part.ContentType, "image/") && part.ContentType != "image/svg+xml" {
+        result.disposition = "inline"
+    }
+    if charset, ok := part.ContentTypeParams["charset"]; ok {
+        result.contentType = mime.FormatMediaType(part.ContentType, map[string]string{"charset": charset})
+    }
+    if result.contentType == "" {
+        result.contentType = "application/octet-stream"
+    }
+    if result.filename == "" {
+        result.filename = fmt.Sprintf("message-%d-part-%s%s", message, section, extension(part.ContentType))
+    }
+    if email.Summary != nil {
+        result.modified = email.Summary.InternalDate
+    }
+
+    return result
+}
+
+// a file name extension for a MIME type, or ""
+func extension(contentType string) string {
+    if models.IsMessageType(contentType) {
+        return ".eml"
+    }
+    if exts, err := mime.ExtensionsByType(contentType); err == nil && len(exts) > 0 {
+        return exts[0]
+    }
+    return ""
+}
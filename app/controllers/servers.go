@@ -3,6 +3,8 @@ package controllers
 import (
     "github.com/robfig/revel"
     "github.com/justjake/mail/app/models"
+    "bytes"
+    "time"
 )
 
 type Servers struct {
@@ -38,7 +40,8 @@ func (c Servers) Index() revel.Result {
 }
 
 // accepts a post to create a new server
-func (c Servers) Add(hostname, username, password string, useTLS bool) revel.Result {
+// if trace is set, the IMAP conversation is recorded from the start
+func (c Servers) Add(hostname, username, password string, useTLS, trace bool) revel.Result {
     // make sure we have the big-3 data we need to connect to a server
     // tls we will assume is False if it is unspecified
     c.Validation.Required(hostname).Message("You must specify a server to add.")
@@ -55,6 +58,9 @@ func (c Servers) Add(hostname, username, password string, useTLS bool) revel.Res
     // create the server
     server := models.NewServer(hostname, username, password)
     server.UseTLS = useTLS
+    if trace {
+        server.EnableTrace()
+    }
 
     // test connection
     _, err := server.Connect()
@@ -124,7 +130,44 @@ func (c Servers) Remove(hostname string) revel.Result {
     return c.Redirect(Servers.Index)
 }
 
+// turn protocol tracing on or off for a server
+func (c Servers) SetTrace(hostname string, enable bool) revel.Result {
+    c.Validation.Required(hostname).Message("You must specify a host to trace.")
+    if c.Validation.HasErrors() {
+        c.Validation.Keep()
+        c.FlashParams()
+        return c.Redirect(Servers.Index)
+    }
+
+    session := models.GetSession(c.Session.Id())
+
+    if server, ok := session[hostname]; ok {
+        if enable {
+            server.EnableTrace()
+            c.Flash.Success("Tracing IMAP traffic for %s.", hostname)
+        } else {
+            server.DisableTrace()
+            c.Flash.Success("Stopped tracing %s.", hostname)
+        }
+        return c.Redirect(Servers.Index)
+    }
 
+    c.Flash.Error("Server %s not found for this session.", hostname)
+    return c.Redirect(Servers.Index)
+}
 
+// download the redacted IMAP transcript for a server as a text file
+func (c Servers) Trace(hostname string) revel.Result {
+    session := models.GetSession(c.Session.Id())
 
+    server, ok := session[hostname]
+    if !ok {
+        return c.NotFound("Server %s not found for this session.", hostname)
+    }
+    if server.Trace == nil {
+        return c.NotFound("Tracing is not enabled for %s.", hostname)
+    }
 
+    return c.RenderBinary(bytes.NewReader(server.Trace.Bytes()),
+        hostname + "-imap.log", revel.Attachment, time.Now())
+}
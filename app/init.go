@@ -1,6 +1,10 @@
 package app
 
-import "github.com/robfig/revel"
+import (
+	"github.com/justjake/mail/app/models"
+	"github.com/robfig/revel"
+	"time"
+)
 
 func init() {
 	// Filters is the default set of global filters.
@@ -17,3 +21,36 @@ func init() {
 		revel.ActionInvoker,           // Invoke the action.
 	}
 }
+
+// read our settings out of app.conf
+func configure() {
+	if dir, ok := revel.Config.String("mail.cache.dir"); ok && dir != "" {
+		size := int64(revel.Config.IntDefault("mail.cache.size", models.DefaultCacheSize>>20)) << 20
+		cache, err := models.NewDiskCache(dir, size)
+		if err != nil {
+			revel.ERROR.Printf("could not open message cache in %s: %v", dir, err)
+		} else {
+			models.Cache = cache
+		}
+	}
+
+	// sizes in megabytes
+	limits := &models.DefaultParseLimits
+	limits.MaxPartSize = int64(revel.Config.IntDefault("mail.parse.maxpart", int(limits.MaxPartSize>>20))) << 20
+	limits.MaxTotalSize = int64(revel.Config.IntDefault("mail.parse.maxtotal", int(limits.MaxTotalSize>>20))) << 20
+	limits.SpoolSize = int64(revel.Config.IntDefault("mail.parse.spool", int(limits.SpoolSize>>20))) << 20
+	limits.TempDir = revel.Config.StringDefault("mail.parse.tmpdir", limits.TempDir)
+
+	if window, ok := revel.Config.String("mail.undo.window"); ok {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			revel.ERROR.Printf("bad mail.undo.window %q: %v", window, err)
+			return
+		}
+		models.UndoWindow = d
+	}
+}
+
+func init() {
+	revel.OnAppStart(configure)
+}
@@ -0,0 +1,59 @@
+package models
+
+// storing new messages in a mailbox with APPEND, for restoring backups and
+// saving drafts and sent mail.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "time"
+)
+
+// store a message in this mailbox. flags and internalDate are optional; a
+// zero internalDate lets the server use the current time. Returns the new
+// message's UID, or 0 if the server doesn't support UIDPLUS.
+func (m *Mailbox) Append(r io.Reader, flags []string, internalDate time.Time) (uint32, error) {
+    if err := checkFlags(flags); err != nil { return 0, err }
+
+    raw, err := ioutil.ReadAll(r)
+    if err != nil { return 0, err }
+    if len(raw) == 0 {
+        return 0, fmt.Errorf("message is empty")
+    }
+
+    c, err := m.server.Connect()
+    if err != nil { return 0, err }
+
+    var fs imap.FlagSet
+    if len(flags) > 0 {
+        fs = imap.NewFlagSet(flags...)
+    }
+    var idate *time.Time
+    if !internalDate.IsZero() {
+        idate = &internalDate
+    }
+
+    cmd, err := imap.Wait(c.Append(m.Name, fs, idate, imap.NewLiteral(crlf(raw))))
+    if err != nil { return 0, err }
+
+    // APPENDUID uidvalidity uid
+    rsp, err := cmd.Result(imap.OK)
+    if err != nil { return 0, err }
+    if rsp.Label != "APPENDUID" || len(rsp.Fields) < 3 {
+        return 0, nil
+    }
+    return imap.AsNumber(rsp.Fields[2]), nil
+}
+
+// IMAP wants CRLF line endings, and .eml files saved on unix usually
+// don't have them
+func crlf(raw []byte) []byte {
+    if bytes.Count(raw, []byte("\n")) == bytes.Count(raw, []byte("\r\n")) {
+        return raw
+    }
+    raw = bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1)
+    return bytes.Replace(raw, []byte("\n"), []byte("\r\n"), -1)
+}
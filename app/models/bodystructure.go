@@ -0,0 +1,210 @@
+package models
+
+// BODYSTRUCTURE parsing. This tells us the MIME tree of a message without
+// downloading any of it.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "fmt"
+    "strings"
+)
+
+// one part of a message, as described by BODYSTRUCTURE
+type BodyStructure struct {
+    // lowercase MIME type, like "text" and "plain"
+    Type        string
+    Subtype     string
+    Params      map[string]string
+    // Content-ID, Content-Description and Content-Transfer-Encoding
+    ID          string
+    Description string
+    Encoding    string
+    // size of the (encoded) part in bytes
+    Size        uint32
+    // text and message/rfc822 parts know how many lines they are
+    Lines       uint32
+
+    Disposition       string
+    DispositionParams map[string]string
+
+    // children of a multipart, or the body of a message/rfc822
+    Parts       []*BodyStructure
+    // headers of an attached message/rfc822
+    Envelope    *Envelope
+
+    // the part specifier for fetching this part, like "1.2".
+    // "" for the top-level multipart
+    Section     string
+}
+
+// "text/plain"
+func (b *BodyStructure) MimeType() string {
+    return b.Type + "/" + b.Subtype
+}
+
+func (b *BodyStructure) IsMultipart() bool {
+    return b.Type == "multipart"
+}
+
+// is this part something the user would call an attachment?
+func (b *BodyStructure) IsAttachment() bool {
+    if b.IsMultipart() { return false }
+    if b.Disposition == "attachment" { return true }
+    if b.Disposition == "inline" { return false }
+    // no disposition: named non-text parts are attachments
+    _, named := b.Params["name"]
+    return named && b.Type != "text"
+}
+
+// is there an attachment anywhere in this part?
+func (b *BodyStructure) HasAttachments() bool {
+    if b.IsAttachment() { return true }
+    for _, part := range b.Parts {
+        if part.HasAttachments() { return true }
+    }
+    return false
+}
+
+// run a function on each part in the tree
+func (b *BodyStructure) ForEach(f func(*BodyStructure)) {
+    f(b)
+    for _, part := range b.Parts {
+        part.ForEach(f)
+    }
+}
+
+// parse a BODYSTRUCTURE response field. nil if it's nonsense.
+func parseBodyStructure(f imap.Field) *BodyStructure {
+    list := imap.AsList(f)
+    if list == nil { return nil }
+    body, err := parseBodyPart(list, "")
+    if err != nil { return nil }
+    return body
+}
+
+// parse one body. `section` is this body's part specifier, or "" for the
+// top level
+func parseBodyPart(list []imap.Field, section string) (*BodyStructure, error) {
+    if len(list) == 0 {
+        return nil, fmt.Errorf("empty body structure")
+    }
+
+    // multipart bodies start with their children
+    if imap.TypeOf(list[0]) == imap.List {
+        return parseMultipart(list, section)
+    }
+
+    if len(list) < 7 {
+        return nil, fmt.Errorf("short body structure %v", list)
+    }
+
+    // a single part message is part 1
+    if section == "" {
+        section = "1"
+    }
+
+    body := &BodyStructure{
+        Type:        strings.ToLower(imap.AsString(list[0])),
+        Subtype:     strings.ToLower(imap.AsString(list[1])),
+        Params:      parseParams(list[2]),
+        ID:          imap.AsString(list[3]),
+        Description: DecodeHeader(imap.AsString(list[4])),
+        Encoding:    strings.ToLower(imap.AsString(list[5])),
+        Size:        imap.AsNumber(list[6]),
+        Section:     section,
+    }
+    rest := list[7:]
+
+    switch {
+    case IsMessageType(body.MimeType()):
+        // envelope, body, lines. A message/global that's transfer-encoded
+        // is described like any other leaf, so its extension data follows
+        // straight on instead
+        if len(rest) >= 3 && imap.TypeOf(rest[0]) == imap.List && imap.TypeOf(rest[1]) == imap.List {
+            body.Envelope = parseEnvelope(rest[0])
+            inner := imap.AsList(rest[1])
+            // the parts of an attached message are numbered under it.
+            // a multipart body has no number of its own, so its children
+            // are N.1, N.2...; a single part body is N.1
+            innerSection := section + ".1"
+            if len(inner) > 0 && imap.TypeOf(inner[0]) == imap.List {
+                innerSection = section
+            }
+            if child, err := parseBodyPart(inner, innerSection); err == nil {
+                body.Parts = []*BodyStructure{child}
+            }
+            body.Lines = imap.AsNumber(rest[2])
+            rest = rest[3:]
+        }
+    case body.Type == "text":
+        if len(rest) >= 1 {
+            body.Lines = imap.AsNumber(rest[0])
+            rest = rest[1:]
+        }
+    }
+
+    // extension data: md5, disposition, language, location
+    if len(rest) >= 2 {
+        body.parseDisposition(rest[1])
+    }
+
+    return body, nil
+}
+
+// parse a multipart body: (child)(child)... subtype params disposition ...
+func parseMultipart(list []imap.Field, section string) (*BodyStructure, error) {
+    body := &BodyStructure{
+        Type: "multipart",
+        Parts: make([]*BodyStructure, 0, 2),
+        Section: section,
+    }
+
+    i := 0
+    for ; i < len(list) && imap.TypeOf(list[i]) == imap.List; i++ {
+        child, err := parseBodyPart(imap.AsList(list[i]), subSection(section, i + 1))
+        if err != nil { return nil, err }
+        body.Parts = append(body.Parts, child)
+    }
+
+    rest := list[i:]
+    if len(rest) >= 1 {
+        body.Subtype = strings.ToLower(imap.AsString(rest[0]))
+    }
+    if len(rest) >= 2 {
+        body.Params = parseParams(rest[1])
+    }
+    if len(rest) >= 3 {
+        body.parseDisposition(rest[2])
+    }
+
+    return body, nil
+}
+
+// the section number of the n'th child of a part
+func subSection(parent string, n int) string {
+    if parent == "" {
+        return fmt.Sprint(n)
+    }
+    return fmt.Sprintf("%s.%d", parent, n)
+}
+
+// ("attachment" ("filename" "a.txt"))
+func (b *BodyStructure) parseDisposition(f imap.Field) {
+    disp := imap.AsList(f)
+    if len(disp) < 1 { return }
+    b.Disposition = strings.ToLower(imap.AsString(disp[0]))
+    if len(disp) >= 2 {
+        b.DispositionParams = parseParams(disp[1])
+    }
+}
+
+// ("charset" "utf-8" "name" "x.pdf") -> map. Keys are lowercased, and
+// values decoded (servers pass RFC 2231 parameters through untouched)
+func parseParams(f imap.Field) map[string]string {
+    raw := make(map[string]string)
+    list := imap.AsList(f)
+    for i := 0; i + 1 < len(list); i += 2 {
+        raw[strings.ToLower(imap.AsString(list[i]))] = imap.AsString(list[i + 1])
+    }
+    return decodeParams(raw)
+}
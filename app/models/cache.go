@@ -0,0 +1,307 @@
+package models
+
+// an on-disk cache of message summaries and fetched bodies, so a restart
+// doesn't mean downloading everything again. Entries are files under a
+// directory tree keyed by host, user, mailbox, UIDVALIDITY and UID; the
+// least recently used ones are deleted once the cache grows past its size
+// limit. UIDs are never reused under the same UIDVALIDITY, so entries never
+// go stale - old ones just stop being read and get evicted.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "container/list"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// the cache the models read through. nil turns caching off.
+// Set up from app.conf at startup.
+var Cache *DiskCache
+
+// default size limit for the cache
+const DefaultCacheSize = 256 << 20
+
+// a size-bounded LRU cache of files in a directory
+type DiskCache struct {
+    dir      string
+    maxBytes int64
+
+    lock     sync.Mutex
+    size     int64
+    // most recently used at the front
+    order    *list.List
+    entries  map[string]*list.Element
+}
+
+type diskEntry struct {
+    key  string
+    size int64
+}
+
+// open a cache in dir, creating it if needed. Files already there are
+// picked up, oldest modification time first in line for eviction. The
+// cache holds people's mail in plain text, so dir has to be absolute: a
+// relative one would land wherever the server happened to be started.
+// Everything in it is only readable by us.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+    if !filepath.IsAbs(dir) {
+        return nil, fmt.Errorf("cache directory %q is not an absolute path", dir)
+    }
+    if err := os.MkdirAll(dir, 0700); err != nil { return nil, err }
+
+    d := &DiskCache{
+        dir: dir,
+        maxBytes: maxBytes,
+        order: list.New(),
+        entries: make(map[string]*list.Element),
+    }
+
+    files := make(byModTime, 0)
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil { return err }
+        if info.IsDir() { return nil }
+        key, err := filepath.Rel(dir, path)
+        if err != nil { return err }
+        // half-written files from a crash
+        if strings.HasSuffix(key, ".tmp") {
+            os.Remove(path)
+            return nil
+        }
+        files = append(files, cacheFile{filepath.ToSlash(key), info.Size(), info.ModTime()})
+        return nil
+    })
+    if err != nil { return nil, err }
+
+    sort.Sort(files)
+    for _, f := range files {
+        d.entries[f.key] = d.order.PushBack(&diskEntry{f.key, f.size})
+        d.size += f.size
+    }
+
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    d.evict()
+    return d, nil
+}
+
+// a file found when opening the cache
+type cacheFile struct {
+    key     string
+    size    int64
+    modTime time.Time
+}
+
+// sorts newest first
+type byModTime []cacheFile
+
+func (f byModTime) Len() int           { return len(f) }
+func (f byModTime) Less(i, j int) bool { return f[i].modTime.After(f[j].modTime) }
+func (f byModTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+func (d *DiskCache) path(key string) string {
+    return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+// read an entry, marking it recently used
+func (d *DiskCache) Get(key string) ([]byte, bool) {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+
+    elem, ok := d.entries[key]
+    if !ok { return nil, false }
+
+    data, err := ioutil.ReadFile(d.path(key))
+    if err != nil {
+        d.remove(elem)
+        return nil, false
+    }
+
+    d.order.MoveToFront(elem)
+    // so the order survives a restart
+    now := time.Now()
+    os.Chtimes(d.path(key), now, now)
+    return data, true
+}
+
+// store an entry, evicting old ones to make room
+func (d *DiskCache) Put(key string, data []byte) error {
+    // no point keeping something bigger than the whole cache
+    if int64(len(data)) > d.maxBytes { return nil }
+
+    d.lock.Lock()
+    defer d.lock.Unlock()
+
+    path := d.path(key)
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil { return err }
+    // write then rename, so readers never see half an entry
+    if err := ioutil.WriteFile(path + ".tmp", data, 0600); err != nil { return err }
+    if err := os.Rename(path + ".tmp", path); err != nil { return err }
+
+    if elem, ok := d.entries[key]; ok {
+        entry := elem.Value.(*diskEntry)
+        d.size -= entry.size
+        entry.size = int64(len(data))
+        d.order.MoveToFront(elem)
+    } else {
+        d.entries[key] = d.order.PushFront(&diskEntry{key, int64(len(data))})
+    }
+    d.size += int64(len(data))
+
+    d.evict()
+    return nil
+}
+
+// drop an entry
+func (d *DiskCache) Remove(key string) {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+
+    if elem, ok := d.entries[key]; ok {
+        d.remove(elem)
+    }
+}
+
+// total bytes stored
+func (d *DiskCache) Size() int64 {
+    d.lock.Lock()
+    defer d.lock.Unlock()
+    return d.size
+}
+
+// delete least recently used entries until we're under the limit.
+// must be called with the lock held.
+func (d *DiskCache) evict() {
+    for d.size > d.maxBytes {
+        elem := d.order.Back()
+        if elem == nil { return }
+        d.remove(elem)
+    }
+}
+
+// must be called with the lock held
+func (d *DiskCache) remove(elem *list.Element) {
+    entry := elem.Value.(*diskEntry)
+    os.Remove(d.path(entry.key))
+    d.order.Remove(elem)
+    delete(d.entries, entry.key)
+    d.size -= entry.size
+}
+
+//////// mailbox read-through ////////
+
+// what we keep on disk for the message list
+type cachedEmail struct {
+    Summary   *Summary
+    Structure *BodyStructure
+    Flags     []string
+}
+
+// escape a key component so it's a single safe path segment
+func cacheSegment(s string) string {
+    return strings.Replace(url.QueryEscape(s), ".", "%2E", -1)
+}
+
+// the cache key for an item belonging to a message in this mailbox.
+// "" if we don't know the UIDVALIDITY yet, and so can't cache anything.
+func (m *Mailbox) cacheKey(uid uint32, item string) string {
+    if m.UIDValidity == 0 { return "" }
+    return strings.Join([]string{
+        cacheSegment(m.server.Hostname),
+        cacheSegment(m.server.Username),
+        cacheSegment(m.Name),
+        fmt.Sprint(m.UIDValidity),
+        fmt.Sprint(uid),
+        cacheSegment(item),
+    }, "/")
+}
+
+// write a message's summary to the disk cache
+func (m *Mailbox) cacheEmail(email *Email) {
+    key := m.cacheKey(email.UID, "summary")
+    if Cache == nil || key == "" { return }
+
+    data, err := json.Marshal(&cachedEmail{email.Summary, email.structure, email.Flags})
+    if err == nil {
+        err = Cache.Put(key, data)
+    }
+    if err != nil {
+        m.server.logf("could not cache UID %d: %v", email.UID, err)
+    }
+}
+
+// load messages in a UID set from the disk cache into Mail. Their flags
+// might be out of date. Returns the loaded messages, and the UIDs that
+// still have to be fetched.
+func (m *Mailbox) loadCached(set *imap.SeqSet) ([]*Email, *imap.SeqSet) {
+    if Cache == nil || m.UIDValidity == 0 || set.Dynamic() {
+        return nil, set
+    }
+    uids, err := expandSet(set.String())
+    if err != nil { return nil, set }
+
+    loaded := make([]*Email, 0)
+    rest := &imap.SeqSet{}
+    for _, uid := range uids {
+        if _, ok := m.Mail[uid]; !ok {
+            if email := m.cachedEmail(uid); email != nil {
+                m.Mail[uid] = email
+                loaded = append(loaded, email)
+                continue
+            }
+        }
+        rest.AddNum(uid)
+    }
+    return loaded, rest
+}
+
+// read one message summary from the disk cache
+func (m *Mailbox) cachedEmail(uid uint32) *Email {
+    data, ok := Cache.Get(m.cacheKey(uid, "summary"))
+    if !ok { return nil }
+
+    var cached cachedEmail
+    if err := json.Unmarshal(data, &cached); err != nil || cached.Summary == nil {
+        return nil
+    }
+    if cached.Flags == nil {
+        cached.Flags = make([]string, 0)
+    }
+
+    if uid > m.latestMessage {
+        m.latestMessage = uid
+    }
+    return &Email{
+        server: m.server,
+        mailbox: m,
+        UID: uid,
+        Summary: cached.Summary,
+        structure: cached.Structure,
+        Flags: cached.Flags,
+        added: m.generation,
+        changed: m.generation,
+    }
+}
+
+// a fetched part of this message from the disk cache, like "BODY[TEXT]"
+func (m *Email) cachedPart(item string) ([]byte, bool) {
+    key := m.mailbox.cacheKey(m.UID, item)
+    if Cache == nil || key == "" { return nil, false }
+    return Cache.Get(key)
+}
+
+// save a fetched part of this message to the disk cache
+func (m *Email) cachePart(item string, data []byte) {
+    key := m.mailbox.cacheKey(m.UID, item)
+    if Cache == nil || key == "" || data == nil { return }
+    if err := Cache.Put(key, data); err != nil {
+        m.server.logf("could not cache %s of UID %d: %v", item, m.UID, err)
+    }
+}
@@ -0,0 +1,161 @@
+package models
+
+// converting text parts to UTF-8 from whatever charset they were sent in
+
+import (
+    "bytes"
+    "strings"
+    "unicode/utf8"
+
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/htmlindex"
+    "golang.org/x/text/encoding/ianaindex"
+    "golang.org/x/text/encoding/japanese"
+    "golang.org/x/text/encoding/korean"
+    "golang.org/x/text/encoding/simplifiedchinese"
+    "golang.org/x/text/encoding/charmap"
+)
+
+// what we assume 8-bit text with no usable charset is. It's what most
+// mislabeled mail turns out to be, and a superset of ISO-8859-1.
+var FallbackCharset encoding.Encoding = charmap.Windows1252
+
+// find the decoder for a charset name. nil if we don't know it.
+func lookupCharset(name string) encoding.Encoding {
+    name = strings.ToLower(strings.Trim(strings.TrimSpace(name), `"'`))
+    if name == "" { return nil }
+
+    // the WHATWG names cover what browsers handle, and map the usual
+    // mislabelings (iso-8859-1 is really windows-1252, etc)
+    if enc, err := htmlindex.Get(name); err == nil {
+        return enc
+    }
+    if enc, err := ianaindex.IANA.Encoding(name); err == nil && enc != nil {
+        return enc
+    }
+    // "x-" prefixed and similar made-up names
+    if strings.HasPrefix(name, "x-") {
+        return lookupCharset(name[2:])
+    }
+    return nil
+}
+
+// convert text to UTF-8 from the given charset. If we don't know the
+// charset, or there isn't one, we guess.
+func toUTF8(charset string, data []byte) []byte {
+    enc := lookupCharset(charset)
+    if enc == nil {
+        if charset != "" && !strings.EqualFold(charset, "us-ascii") {
+            debug("unknown charset ", charset, ", guessing")
+        }
+        enc = guessCharset(data)
+    }
+    if enc == encoding.Nop {
+        return data
+    }
+
+    converted, err := enc.NewDecoder().Bytes(data)
+    if err != nil {
+        debug("could not convert from ", charset, ": ", err)
+        return data
+    }
+    return converted
+}
+
+// a best guess at the charset of some text we know nothing about: one of
+// ISO-2022-JP, UTF-8 (which includes ASCII), Shift_JIS, EUC-KR, GB18030,
+// or else FallbackCharset. Other charsets are never guessed.
+func guessCharset(data []byte) encoding.Encoding {
+    // ISO-2022-JP is 7-bit, so it would pass for ASCII, but it switches
+    // character sets with escapes
+    if bytes.Contains(data, []byte("\x1b$B")) || bytes.Contains(data, []byte("\x1b$@")) {
+        return japanese.ISO2022JP
+    }
+    // includes plain ASCII
+    if utf8.Valid(data) {
+        return encoding.Nop
+    }
+    if enc := guessCJK(data); enc != nil {
+        return enc
+    }
+    return FallbackCharset
+}
+
+// which East Asian multibyte charset 8-bit text is in, or nil. Almost any
+// bytes decode as something in these, so the text also has to look like
+// the language once decoded: Japanese has kana, Korean is nearly all
+// Hangul, and Chinese is nearly all Han characters from GB2312, the
+// common subset of GB18030.
+func guessCJK(data []byte) encoding.Encoding {
+    if s := decodeStats(japanese.ShiftJIS, data); s.ok && s.kana * 5 >= s.wide {
+        return japanese.ShiftJIS
+    }
+    if s := decodeStats(korean.EUCKR, data); s.ok && s.hangul * 10 >= s.wide * 9 {
+        return korean.EUCKR
+    }
+    if s := decodeStats(simplifiedchinese.GB18030, data); s.ok && s.han * 10 >= s.wide * 9 && gb2312Share(data) >= 0.8 {
+        return simplifiedchinese.GB18030
+    }
+    return nil
+}
+
+// what text decodes to in a charset, by kind of character
+type charStats struct {
+    // decoded cleanly, with some non-ASCII in it
+    ok     bool
+    // non-ASCII characters
+    wide   int
+    kana   int
+    hangul int
+    // Han characters, and CJK punctuation and full-width forms
+    han    int
+}
+
+func decodeStats(enc encoding.Encoding, data []byte) charStats {
+    var s charStats
+    decoded, err := enc.NewDecoder().Bytes(data)
+    if err != nil { return s }
+    for _, r := range string(decoded) {
+        switch {
+        case r == utf8.RuneError:
+            return charStats{}
+        case r < 0x80:
+            continue
+        case 0x3040 <= r && r <= 0x30ff:
+            s.kana++
+        case 0xac00 <= r && r <= 0xd7a3, 0x1100 <= r && r <= 0x11ff, 0x3130 <= r && r <= 0x318f:
+            s.hangul++
+        case 0x4e00 <= r && r <= 0x9fff, 0x3000 <= r && r <= 0x303f, 0xff00 <= r && r <= 0xffef:
+            s.han++
+        }
+        s.wide++
+    }
+    s.ok = s.wide > 0
+    return s
+}
+
+// the share of GB18030's two-byte characters in data that are in the
+// GB2312 range, where both bytes are 0xA1 or over. Text in other 8-bit
+// charsets rarely has two high bytes in a row so often.
+func gb2312Share(data []byte) float64 {
+    pairs, gb2312 := 0, 0
+    for i := 0; i < len(data); {
+        switch {
+        case data[i] < 0x80:
+            i++
+        case i + 3 < len(data) && '0' <= data[i + 1] && data[i + 1] <= '9':
+            // four-byte sequence
+            i += 4
+        case i + 1 < len(data):
+            pairs++
+            if data[i] >= 0xa1 && data[i + 1] >= 0xa1 {
+                gb2312++
+            }
+            i += 2
+        default:
+            i++
+        }
+    }
+    if pairs == 0 { return 0 }
+    return float64(gb2312) / float64(pairs)
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+    "testing"
+
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/charmap"
+    "golang.org/x/text/encoding/japanese"
+    "golang.org/x/text/encoding/korean"
+    "golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestGuessCharset(t *testing.T) {
+    tests := []struct {
+        name string
+        text string
+        enc  encoding.Encoding
+    }{
+        {"Japanese in Shift_JIS", "こんにちは、世界。今日はいい天気ですね。", japanese.ShiftJIS},
+        {"Japanese in ISO-2022-JP", "こんにちは、世界。", japanese.ISO2022JP},
+        {"Korean in EUC-KR", "안녕하세요, 세계. 오늘 날씨가 좋네요.", korean.EUCKR},
+        {"Chinese in GB18030", "你好，世界。今天天气很好，我们去公园散步吧。", simplifiedchinese.GB18030},
+        {"French in windows-1252", "Élève très sûr de lui, à la fenêtre, ça va.", charmap.Windows1252},
+        {"German in windows-1252", "Größere Übungen für Bären", charmap.Windows1252},
+        {"UTF-8", "Élève 안녕 你好", encoding.Nop},
+        {"ASCII", "plain old text", encoding.Nop},
+    }
+
+    for _, test := range tests {
+        data := []byte(test.text)
+        if test.enc != encoding.Nop {
+            var err error
+            data, err = test.enc.NewEncoder().Bytes(data)
+            if err != nil { t.Fatalf("%s: %v", test.name, err) }
+        }
+
+        guess := guessCharset(data)
+        if guess != test.enc {
+            t.Errorf("%s: guessed %v", test.name, guess)
+            continue
+        }
+        if got := string(toUTF8("", data)); got != test.text {
+            t.Errorf("%s: converted to %q", test.name, got)
+        }
+    }
+}
@@ -0,0 +1,164 @@
+package models
+
+// CONDSTORE and QRESYNC (RFC 7162) let us ask the server for only the
+// messages whose flags changed, and the UIDs that were expunged, since the
+// last time we looked. That's a lot cheaper than refetching FLAGS for a
+// 50k message mailbox every time we reconnect.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "fmt"
+    "strconv"
+)
+
+// teach a freshly connected client about the extension responses we use
+// (CONDSTORE, QRESYNC, ESEARCH, SORT, THREAD, MOVE),
+// and turn on QRESYNC or CONDSTORE if the server has them.
+func (s *Server) enableExtensions(c *imap.Client) error {
+    s.enabled = make(map[string]bool)
+
+    // go-imap doesn't know these responses belong to SELECT and UID FETCH,
+    // so without this they'd end up in c.Data
+    selectFilter := imap.LabelFilter(
+        "FLAGS", "EXISTS", "RECENT",
+        "UNSEEN", "PERMANENTFLAGS", "UIDNEXT", "UIDVALIDITY",
+        "UIDNOTSTICKY", "HIGHESTMODSEQ", "NOMODSEQ",
+    )
+    c.CommandConfig["SELECT"].Filter = selectFilter
+    c.CommandConfig["EXAMINE"].Filter = selectFilter
+    c.CommandConfig["UID FETCH"].Filter = func(cmd *imap.Command, rsp *imap.Response) bool {
+        return rsp.Label == "VANISHED" || imap.FetchFilter(cmd, rsp)
+    }
+    c.CommandConfig["UID SEARCH"].Filter = imap.LabelFilter("SEARCH", "ESEARCH")
+    // with QRESYNC on, expunges are reported as VANISHED
+    c.CommandConfig["EXPUNGE"].Filter = imap.LabelFilter("EXPUNGE", "VANISHED")
+    c.CommandConfig["UID EXPUNGE"].Filter = imap.LabelFilter("EXPUNGE", "VANISHED")
+
+    // RFC 6851. The untagged OK carries COPYUID
+    c.CommandConfig["UID MOVE"] = &imap.CommandConfig{
+        States: imap.Selected,
+        Filter: func(cmd *imap.Command, rsp *imap.Response) bool {
+            return rsp.Label == "EXPUNGE" || rsp.Label == "VANISHED" ||
+                (rsp.Type == imap.Status && rsp.Label == "COPYUID")
+        },
+    }
+
+    // RFC 5256 commands go-imap doesn't know about at all
+    c.CommandConfig["UID SORT"] = &imap.CommandConfig{
+        States: imap.Selected, Filter: imap.LabelFilter("SORT"),
+    }
+    c.CommandConfig["UID THREAD"] = &imap.CommandConfig{
+        States: imap.Selected, Filter: imap.LabelFilter("THREAD"),
+    }
+
+    if !c.Caps["ENABLE"] { return nil }
+
+    var want string
+    if c.Caps["QRESYNC"] {
+        want = "QRESYNC"
+    } else if c.Caps["CONDSTORE"] {
+        want = "CONDSTORE"
+    } else {
+        return nil
+    }
+
+    // not c.Enable, which sends its arguments as a parenthesised list.
+    // ENABLE takes bare atoms.
+    cmd, err := imap.Wait(c.Send("ENABLE", want))
+    if err != nil { return err }
+    for _, rsp := range cmd.Data {
+        for _, f := range rsp.Fields[1:] {
+            s.enabled[imap.AsAtom(f)] = true
+        }
+    }
+    // QRESYNC implies CONDSTORE
+    if s.enabled["QRESYNC"] {
+        s.enabled["CONDSTORE"] = true
+    }
+
+    return nil
+}
+
+// MODSEQ values are 63-bit, so go-imap hands us big ones as atoms
+func asModSeq(f imap.Field) uint64 {
+    switch v := f.(type) {
+    case uint32:
+        return uint64(v)
+    case string:
+        n, _ := strconv.ParseUint(v, 10, 64)
+        return n
+    }
+    return 0
+}
+
+// pull HIGHESTMODSEQ out of a SELECT response. 0 means the mailbox doesn't
+// support mod-sequences (NOMODSEQ) or CONDSTORE isn't on.
+func highestModSeq(cmd *imap.Command) uint64 {
+    for _, rsp := range cmd.Data {
+        if rsp.Label == "HIGHESTMODSEQ" && len(rsp.Fields) > 1 {
+            return asModSeq(rsp.Fields[1])
+        }
+    }
+    return 0
+}
+
+// can we ask for only the changes since our last sync?
+func (m *Mailbox) canResync() bool {
+    return m.server.enabled["CONDSTORE"] && m.HighestModSeq != 0 && m.modSeq != 0
+}
+
+// sync flags and expunges using CHANGEDSINCE.
+// With QRESYNC we also ask for VANISHED, which gives us the expunged UIDs in
+// the same round trip. go-imap's Select doesn't take parameters, so instead
+// of SELECT (QRESYNC ...) we use the equivalent UID FETCH modifier from
+// RFC 7162 section 3.2.6 right after selecting.
+func (m *Mailbox) resync(c *imap.Client) error {
+    // nothing has changed at all
+    if m.modSeq == m.HighestModSeq { return nil }
+
+    qresync := m.server.enabled["QRESYNC"]
+
+    set, err := m.cachedSet()
+    if err != nil { return err }
+
+    modifiers := []imap.Field{"CHANGEDSINCE", m.HighestModSeq}
+    if qresync {
+        modifiers = append(modifiers, "VANISHED")
+    }
+    cmd, err := imap.Wait(c.Send("UID FETCH", set,
+        []imap.Field{"UID", "FLAGS"}, modifiers))
+    if err != nil { return err }
+
+    for _, rsp := range cmd.Data {
+        if rsp.Label == "VANISHED" {
+            m.forgetVanished(rsp)
+            continue
+        }
+        info := rsp.MessageInfo()
+        if email, ok := m.Mail[info.UID]; ok {
+            email.updateFlags(info.Flags)
+        }
+    }
+
+    if !qresync {
+        return m.syncRemoved(c)
+    }
+    return nil
+}
+
+// handle a "* VANISHED (EARLIER) 41,43:116" response
+func (m *Mailbox) forgetVanished(rsp *imap.Response) {
+    // the UID set is the last field; (EARLIER) may come before it
+    raw := rsp.Fields[len(rsp.Fields) - 1]
+    set, err := imap.NewSeqSet(fmt.Sprint(raw))
+    if err != nil {
+        m.server.logf("bad VANISHED response %v: %v", rsp, err)
+        return
+    }
+
+    for uid := range m.Mail {
+        if set.Contains(uid) {
+            m.forget(uid)
+        }
+    }
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestEnableExtensions(t *testing.T) {
+    tests := []struct {
+        name    string
+        caps    string
+        // the ENABLE command line, if one should be sent
+        want    string
+        enabled []string
+    }{
+        {"QRESYNC", "ENABLE CONDSTORE QRESYNC", "ENABLE QRESYNC", []string{"QRESYNC", "CONDSTORE"}},
+        {"CONDSTORE only", "ENABLE CONDSTORE", "ENABLE CONDSTORE", []string{"CONDSTORE"}},
+        {"no ENABLE", "CONDSTORE QRESYNC", "", nil},
+        {"nothing to enable", "ENABLE", "", nil},
+    }
+
+    for _, test := range tests {
+        c, f := newFakeServer(t, test.caps, func(command string) string {
+            if strings.HasPrefix(command, "ENABLE ") {
+                return "* ENABLED " + strings.TrimPrefix(command, "ENABLE ") + "\r\n"
+            }
+            return ""
+        })
+
+        s := &Server{}
+        if err := s.enableExtensions(c); err != nil {
+            t.Errorf("%s: %v", test.name, err)
+        }
+        f.Close()
+
+        sent := make([]string, 0)
+        for _, command := range f.Commands() {
+            if strings.HasPrefix(command, "ENABLE") {
+                sent = append(sent, command)
+            }
+        }
+        if test.want == "" {
+            if len(sent) != 0 {
+                t.Errorf("%s: sent %q", test.name, sent)
+            }
+        } else if len(sent) != 1 || sent[0] != test.want {
+            t.Errorf("%s: sent %q, want %q", test.name, sent, test.want)
+        }
+
+        if len(s.enabled) != len(test.enabled) {
+            t.Errorf("%s: enabled %v, want %v", test.name, s.enabled, test.enabled)
+        }
+        for _, ext := range test.enabled {
+            if !s.enabled[ext] {
+                t.Errorf("%s: %s isn't enabled", test.name, ext)
+            }
+        }
+    }
+}
@@ -0,0 +1,445 @@
+package models
+
+// converting message text between the forms it arrives in and the forms we
+// show (or quote) it in: RFC 3676 format=flowed, HTML, and plain text.
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "regexp"
+    "strings"
+
+    "golang.org/x/net/html"
+    "golang.org/x/net/html/atom"
+)
+
+// the signature separator, which is never flowed
+const sigSeparator = "-- "
+
+// a line of text, and how many levels of "> " quoting it was under
+type quotedLine struct {
+    depth int
+    text  string
+}
+
+// "> > hi" -> 2, "hi". Spaces between quote markers are allowed, as people
+// write them; one space after the markers is part of the quoting.
+func splitQuote(line string) quotedLine {
+    depth, i := 0, 0
+    for i < len(line) {
+        if line[i] == '>' {
+            depth++
+        } else if !(depth > 0 && line[i] == ' ' && i + 1 < len(line) && line[i + 1] == '>') {
+            break
+        }
+        i++
+    }
+    text := line[i:]
+    if depth > 0 {
+        text = strings.TrimPrefix(text, " ")
+    }
+    return quotedLine{depth, text}
+}
+
+// "> " for each level of quoting
+func quotePrefix(depth int) string {
+    if depth == 0 { return "" }
+    return strings.Repeat(">", depth) + " "
+}
+
+// split text into lines, whatever its line endings
+func splitLines(text string) []string {
+    return strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+}
+
+//////// format=flowed ////////
+
+// join the soft line breaks of RFC 3676 format=flowed text back into
+// paragraphs. delSp is the delsp=yes parameter: the space ending a flowed
+// line was added by the sender, and isn't part of the text. Quoted lines
+// come out with a "> " per level.
+func Unflow(text string, delSp bool) string {
+    out := make([]string, 0)
+    // the paragraph we're joining lines onto
+    var para *quotedLine
+    flush := func() {
+        if para != nil {
+            out = append(out, quotePrefix(para.depth) + para.text)
+            para = nil
+        }
+    }
+
+    for _, raw := range splitLines(text) {
+        // flowed quoting is only ">"s, then a space-stuffed line
+        depth := len(raw) - len(strings.TrimLeft(raw, ">"))
+        line := quotedLine{depth, strings.TrimPrefix(raw[depth:], " ")}
+
+        flowed := strings.HasSuffix(line.text, " ") && line.text != sigSeparator
+        if flowed && delSp {
+            line.text = line.text[:len(line.text) - 1]
+        }
+
+        // a change of quote depth ends a paragraph, flowed or not
+        if para != nil && para.depth != line.depth {
+            flush()
+        }
+        if para == nil {
+            para = &line
+        } else {
+            para.text += line.text
+        }
+        if !flowed {
+            flush()
+        }
+    }
+    // a flowed last line is treated as fixed
+    flush()
+    return strings.Join(out, "\n")
+}
+
+//////// text to HTML ////////
+
+// http(s) and www. links, without punctuation at the end of a sentence
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]*[^\s<>".,;:!?'")\]]`)
+
+// render plain text as HTML: quote levels become nested blockquotes, and
+// URLs become links.
+func TextToHTML(text string) string {
+    var out bytes.Buffer
+    depth := 0
+    lines := splitLines(strings.TrimRight(text, "\r\n"))
+    for i, raw := range lines {
+        line := splitQuote(raw)
+        for ; depth < line.depth; depth++ {
+            out.WriteString(`<blockquote type="cite">`)
+        }
+        for ; depth > line.depth; depth-- {
+            out.WriteString("</blockquote>")
+        }
+        out.WriteString(linkify(line.text))
+        if i < len(lines) - 1 {
+            out.WriteString("<br>\n")
+        }
+    }
+    for ; depth > 0; depth-- {
+        out.WriteString("</blockquote>")
+    }
+    return out.String()
+}
+
+// escape a line of text, turning URLs into links
+func linkify(line string) string {
+    var out bytes.Buffer
+    last := 0
+    for _, match := range urlPattern.FindAllStringIndex(line, -1) {
+        out.WriteString(escapeText(line[last:match[0]]))
+        link := line[match[0]:match[1]]
+        href := link
+        if strings.HasPrefix(strings.ToLower(link), "www.") {
+            href = "http://" + link
+        }
+        fmt.Fprintf(&out, `<a href="%s" target="_blank" rel="noopener noreferrer nofollow">%s</a>`,
+            html.EscapeString(href), html.EscapeString(link))
+        last = match[1]
+    }
+    out.WriteString(escapeText(line[last:]))
+    return out.String()
+}
+
+// escape text, keeping runs of spaces (indentation, ascii art) visible
+func escapeText(s string) string {
+    return strings.Replace(html.EscapeString(s), "  ", " &nbsp;", -1)
+}
+
+//////// HTML to text ////////
+
+// render HTML as readable plain text, for mail that has no text part and
+// for quoting it in replies. Paragraphs are separated by blank lines,
+// lists get bullets, blockquotes become "> " quoting and links keep their
+// URLs.
+func HTMLToText(r io.Reader) (string, error) {
+    doc, err := html.Parse(r)
+    if err != nil { return "", err }
+
+    t := &textRenderer{lines: make([]string, 0)}
+    t.render(doc)
+    t.block()
+
+    // no blank lines at the ends
+    lines := t.lines
+    for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+        lines = lines[1:]
+    }
+    for len(lines) > 0 && strings.TrimRight(lines[len(lines) - 1], "> ") == "" {
+        lines = lines[:len(lines) - 1]
+    }
+    return strings.Join(lines, "\n"), nil
+}
+
+// state while rendering HTML to text
+type textRenderer struct {
+    lines []string
+    line  bytes.Buffer
+    // blockquote depth
+    depth int
+    // inside how many <pre>s
+    pre   int
+    // number of the next item of each open list; 0 for unordered lists
+    lists []int
+    // did the last finished line have no text?
+    blank bool
+}
+
+// finish the current line
+func (t *textRenderer) endLine() {
+    text := t.line.String()
+    if t.pre == 0 {
+        text = strings.TrimRight(text, " ")
+    }
+    // kept apart from collapsing, but a space to a text reader
+    text = strings.Replace(text, "\u00a0", " ", -1)
+    t.lines = append(t.lines, strings.TrimRight(quotePrefix(t.depth) + text, " "))
+    t.blank = text == ""
+    t.line.Reset()
+}
+
+// start a new line, unless we're at the start of one
+func (t *textRenderer) block() {
+    if t.line.Len() > 0 {
+        t.endLine()
+    }
+}
+
+// leave a blank line, unless there is one already
+func (t *textRenderer) paragraph() {
+    t.block()
+    if len(t.lines) > 0 && !t.blank {
+        t.endLine()
+    }
+}
+
+// add text, collapsing whitespace the way a browser would outside <pre>
+func (t *textRenderer) write(s string) {
+    if t.pre > 0 {
+        for i, line := range strings.Split(s, "\n") {
+            if i > 0 {
+                t.endLine()
+            }
+            t.line.WriteString(line)
+        }
+        return
+    }
+
+    // nbsp isn't collapsed, so it isn't in here
+    collapsed := strings.Join(strings.FieldsFunc(s, htmlSpace), " ")
+    if strings.TrimLeftFunc(s, htmlSpace) != s {
+        collapsed = " " + collapsed
+    }
+    if collapsed != " " && strings.TrimRightFunc(s, htmlSpace) != s {
+        collapsed += " "
+    }
+    t.writeCollapsed(collapsed)
+}
+
+// whitespace as far as HTML is concerned
+func htmlSpace(r rune) bool {
+    return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f'
+}
+
+// add collapsed text, without doubling spaces or starting a line with one
+func (t *textRenderer) writeCollapsed(s string) {
+    current := t.line.String()
+    if current == "" || strings.HasSuffix(current, " ") {
+        s = strings.TrimLeft(s, " ")
+    }
+    t.line.WriteString(s)
+}
+
+// elements whose content isn't text for the reader
+var skippedElements = map[atom.Atom]bool{
+    atom.Head: true, atom.Script: true, atom.Style: true, atom.Title: true,
+    atom.Noscript: true, atom.Template: true,
+}
+
+// elements that start a new paragraph
+var paragraphElements = map[atom.Atom]bool{
+    atom.P: true, atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true,
+    atom.H5: true, atom.H6: true, atom.Table: true, atom.Ul: true,
+    atom.Ol: true, atom.Dl: true, atom.Pre: true, atom.Address: true,
+}
+
+// elements that start a new line
+var blockElements = map[atom.Atom]bool{
+    atom.Div: true, atom.Tr: true, atom.Dt: true, atom.Dd: true,
+    atom.Center: true, atom.Caption: true,
+}
+
+func (t *textRenderer) render(n *html.Node) {
+    switch n.Type {
+    case html.TextNode:
+        t.write(n.Data)
+        return
+    case html.ElementNode:
+    default:
+        t.children(n)
+        return
+    }
+
+    switch {
+    case skippedElements[n.DataAtom]:
+
+    case n.DataAtom == atom.Br:
+        t.endLine()
+
+    case n.DataAtom == atom.Hr:
+        t.block()
+        t.line.WriteString("----------")
+        t.endLine()
+
+    case n.DataAtom == atom.Img:
+        if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+            t.write(alt)
+        }
+
+    case n.DataAtom == atom.Blockquote:
+        t.paragraph()
+        t.depth++
+        // the blank line above belongs outside the quote
+        t.blank = true
+        t.children(n)
+        t.block()
+        // nor does the blank line below
+        if last := len(t.lines) - 1; t.blank && last >= 0 && t.lines[last] == strings.TrimRight(quotePrefix(t.depth), " ") {
+            t.lines = t.lines[:last]
+        }
+        t.depth--
+        t.blank = false
+        t.paragraph()
+
+    case n.DataAtom == atom.Ul || n.DataAtom == atom.Ol:
+        next := 0
+        if n.DataAtom == atom.Ol {
+            next = 1
+        }
+        if len(t.lists) == 0 {
+            t.paragraph()
+        } else {
+            t.block()
+        }
+        t.lists = append(t.lists, next)
+        t.children(n)
+        t.lists = t.lists[:len(t.lists) - 1]
+        if len(t.lists) == 0 {
+            t.paragraph()
+        }
+
+    case n.DataAtom == atom.Li:
+        t.block()
+        t.line.WriteString(t.bullet())
+        t.children(n)
+        t.block()
+
+    case n.DataAtom == atom.Td || n.DataAtom == atom.Th:
+        if t.line.Len() > 0 {
+            t.writeCollapsed(" ")
+        }
+        t.children(n)
+
+    case n.DataAtom == atom.A:
+        start := t.line.Len()
+        t.children(n)
+        href := attr(n, "href")
+        lower := strings.ToLower(href)
+        if !strings.HasPrefix(lower, "http:") && !strings.HasPrefix(lower, "https:") {
+            return
+        }
+        // nothing to add if the link text is the URL
+        if text := strings.TrimSpace(t.line.String()[minInt(start, t.line.Len()):]); text != href {
+            t.writeCollapsed(" <" + href + ">")
+        }
+
+    case n.DataAtom == atom.Pre:
+        t.paragraph()
+        t.pre++
+        t.children(n)
+        t.pre--
+        t.paragraph()
+
+    case paragraphElements[n.DataAtom]:
+        t.paragraph()
+        t.children(n)
+        t.paragraph()
+
+    case blockElements[n.DataAtom]:
+        t.block()
+        t.children(n)
+        t.block()
+
+    default:
+        t.children(n)
+    }
+}
+
+func (t *textRenderer) children(n *html.Node) {
+    for child := n.FirstChild; child != nil; child = child.NextSibling {
+        t.render(child)
+    }
+}
+
+// "* " or "3. ", indented for nested lists
+func (t *textRenderer) bullet() string {
+    indent := strings.Repeat("  ", len(t.lists) - 1)
+    last := len(t.lists) - 1
+    if last < 0 || t.lists[last] == 0 {
+        return indent + "* "
+    }
+    t.lists[last]++
+    return fmt.Sprintf("%s%d. ", indent, t.lists[last] - 1)
+}
+
+// the value of an attribute, or ""
+func attr(n *html.Node, key string) string {
+    for _, a := range n.Attr {
+        if a.Key == key {
+            return a.Val
+        }
+    }
+    return ""
+}
+
+func minInt(a, b int) int {
+    if a < b { return a }
+    return b
+}
+
+//////// message parts ////////
+
+// the text of a text part for reading or quoting: flowed text is reflowed,
+// and HTML rendered as plain text
+func (node *MessageNode) PlainText() (string, error) {
+    if node.Body == nil { return "", nil }
+    data, err := node.Body.Data()
+    if err != nil { return "", err }
+
+    if node.ContentType == TypeHTML {
+        return HTMLToText(bytes.NewReader(data))
+    }
+
+    text := string(data)
+    if strings.EqualFold(node.ContentTypeParams["format"], "flowed") {
+        text = Unflow(text, strings.EqualFold(node.ContentTypeParams["delsp"], "yes"))
+    }
+    return text, nil
+}
+
+// a text part as HTML that's safe to show: HTML parts are sanitized, plain
+// text is converted
+func (node *MessageNode) HTML() (string, error) {
+    if node.ContentType == TypeHTML {
+        return node.Sanitized, nil
+    }
+    text, err := node.PlainText()
+    if err != nil { return "", err }
+    return TextToHTML(text), nil
+}
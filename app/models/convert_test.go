@@ -0,0 +1,146 @@
+package models
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestUnflow(t *testing.T) {
+    tests := []struct {
+        name  string
+        in    string
+        delSp bool
+        want  string
+    }{
+        {"soft breaks join",
+            "a flowed \r\nparagraph\r\nfixed line", false,
+            "a flowed paragraph\nfixed line"},
+        {"delsp drops the added space",
+            "日本 \r\n語", true,
+            "日本語"},
+        {"without delsp the space stays",
+            "日本 \r\n語", false,
+            "日本 語"},
+        {"the signature separator isn't flowed",
+            "text\r\n-- \r\nsig \r\nline", false,
+            "text\n-- \nsig line"},
+        {"a quote depth change ends a paragraph",
+            ">> deep \r\n> shallow \r\nnot quoted", false,
+            ">> deep \n> shallow \nnot quoted"},
+        {"quoted lines flow at the same depth",
+            "> one \r\n> two\r\n>> three", false,
+            "> one two\n>> three"},
+        {"space-stuffed lines",
+            "  indented\r\n From", false,
+            " indented\nFrom"},
+        {"a flowed last line is fixed",
+            "end ", true,
+            "end"},
+    }
+
+    for _, test := range tests {
+        if got := Unflow(test.in, test.delSp); got != test.want {
+            t.Errorf("%s: Unflow(%q, %v)\n  got  %q\n  want %q", test.name, test.in, test.delSp, got, test.want)
+        }
+    }
+}
+
+func TestTextToHTML(t *testing.T) {
+    tests := []struct {
+        name string
+        in   string
+        want string
+    }{
+        {"quote levels nest",
+            "hi\n> quoted\n>> deeper\nback",
+            `hi<br>` + "\n" + `<blockquote type="cite">quoted<br>` + "\n" +
+                `<blockquote type="cite">deeper<br>` + "\n" + `</blockquote></blockquote>back`},
+        {"text is escaped",
+            `<script> & "x"`,
+            `&lt;script&gt; &amp; &#34;x&#34;`},
+        {"links are escaped",
+            `see https://example.com/?a=1&b=<2> now`,
+            `see <a href="https://example.com/?a=1&amp;b=" target="_blank" rel="noopener noreferrer nofollow">` +
+                `https://example.com/?a=1&amp;b=</a>&lt;2&gt; now`},
+        {"www links get a scheme, sentences keep their full stop",
+            "go to www.example.com.",
+            `go to <a href="http://www.example.com" target="_blank" rel="noopener noreferrer nofollow">` +
+                `www.example.com</a>.`},
+        {"other schemes aren't linked",
+            "javascript:alert(1)",
+            "javascript:alert(1)"},
+        {"runs of spaces stay visible",
+            "a   b",
+            "a &nbsp; b"},
+    }
+
+    for _, test := range tests {
+        if got := TextToHTML(test.in); got != test.want {
+            t.Errorf("%s: TextToHTML(%q)\n  got  %q\n  want %q", test.name, test.in, got, test.want)
+        }
+    }
+}
+
+func TestHTMLToText(t *testing.T) {
+    tests := []struct {
+        name string
+        in   string
+        want string
+    }{
+        {"paragraphs",
+            "<p>one\n  two</p><p>three</p>",
+            "one two\n\nthree"},
+        {"blockquotes",
+            "<p>reply</p><blockquote><p>quoted</p><blockquote>deeper</blockquote></blockquote>",
+            "reply\n\n> quoted\n>\n>> deeper"},
+        {"lists",
+            "<ul><li>one</li><li>two</li></ul><ol><li>first</li></ol>",
+            "* one\n* two\n\n1. first"},
+        {"scripts and styles are dropped",
+            "<style>p {}</style><script>x()</script>text",
+            "text"},
+    }
+
+    for _, test := range tests {
+        got, err := HTMLToText(strings.NewReader(test.in))
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+        } else if got != test.want {
+            t.Errorf("%s: HTMLToText(%q)\n  got  %q\n  want %q", test.name, test.in, got, test.want)
+        }
+    }
+}
+
+func TestDisplayRendersText(t *testing.T) {
+    html := &MessageNode{ContentType: TypeHTML}
+    html.Header = map[string][]string{}
+    html.SetBody([]byte("<p>Hello <b>there</b></p>"))
+
+    plain := &MessageNode{ContentType: TypePlain, ContentTypeParams: map[string]string{"format": "flowed"}}
+    plain.Header = map[string][]string{}
+    plain.SetBody([]byte("flowed \r\ntext & more"))
+
+    tests := []struct {
+        name       string
+        node       *MessageNode
+        preferHTML bool
+        html, text string
+    }{
+        {"HTML-only mail, plain preferred", html, false, "", "Hello there"},
+        {"HTML-only mail, HTML preferred", html, true, "<p>Hello <b>there</b></p>", ""},
+        {"plain mail, plain preferred", plain, false, "", "flowed text & more"},
+        {"plain mail, HTML preferred", plain, true, "flowed text &amp; more", ""},
+    }
+
+    for _, test := range tests {
+        display := test.node.DisplayParts(test.preferHTML)
+        if len(display.Body) != 1 {
+            t.Errorf("%s: %d parts to show", test.name, len(display.Body))
+            continue
+        }
+        part := display.Body[0]
+        if part.HTML != test.html || part.Text != test.text {
+            t.Errorf("%s: got HTML %q, text %q", test.name, part.HTML, part.Text)
+        }
+    }
+}
@@ -0,0 +1,218 @@
+package models
+
+// deleting messages. A delete moves messages to the Trash and hands back an
+// undo token; deleting from the Trash itself is permanent.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "time"
+)
+
+// how long a delete can be undone for. Set from app.conf at startup.
+var UndoWindow = 30 * time.Second
+
+// what we need to put deleted messages back
+type undoEntry struct {
+    from    *Mailbox
+    trash   *Mailbox
+    // UIDs of the messages in the trash, when the server told us
+    uids    []uint32
+    // Message-IDs of the messages it didn't tell us about, to search for
+    lost    []string
+    // UIDs of the originals, if the move had to leave them marked \Deleted
+    left    []uint32
+    expires time.Time
+}
+
+// move messages to the Trash, or expunge them if they're already there.
+// Returns a token for Undo, or "" if the delete was permanent.
+func (m *Mailbox) Delete(uids []uint32) (string, error) {
+    trash, err := m.server.SpecialMailbox(SpecialTrash)
+    if err != nil { return "", err }
+    if trash == nil {
+        return "", fmt.Errorf("%s has no Trash mailbox", m.server.Hostname)
+    }
+
+    if trash == m {
+        return "", m.Expunge(uids)
+    }
+
+    // we need Message-IDs to find the messages again if the server doesn't
+    // tell us their new UIDs
+    emails, err := m.Emails(uids)
+    if err != nil { return "", err }
+
+    moved, left, err := m.moveTo(uids, trash)
+    if err != nil { return "", err }
+
+    entry := &undoEntry{
+        from: m,
+        trash: trash,
+        uids: make([]uint32, 0, len(moved)),
+        lost: make([]string, 0),
+        expires: time.Now().Add(UndoWindow),
+    }
+    if left {
+        entry.left = uids
+    }
+    for _, email := range emails {
+        if uid, ok := moved[email.UID]; ok {
+            entry.uids = append(entry.uids, uid)
+        } else if email.Summary != nil && email.Summary.MessageID != "" {
+            entry.lost = append(entry.lost, email.Summary.MessageID)
+        }
+    }
+
+    return m.server.addUndo(entry)
+}
+
+// delete this message. See Mailbox.Delete
+func (m *Email) Delete() (string, error) {
+    return m.mailbox.Delete([]uint32{m.UID})
+}
+
+// permanently remove messages. If they can't be expunged on their own
+// (see expunge), they're left marked \Deleted, which is as good as gone to
+// most mail clients, and dropped from our cache all the same.
+func (m *Mailbox) Expunge(uids []uint32) error {
+    set, err := uidSet(uids)
+    if err != nil { return err }
+
+    if err := m.AddFlags(uids, FlagDeleted); err != nil { return err }
+
+    // AddFlags left us with the mailbox selected
+    c, err := m.server.Connect()
+    if err != nil { return err }
+    expunged, err := m.expunge(c, uids, set)
+    if err != nil { return err }
+    if !expunged {
+        m.server.logf("leaving deleted messages marked \\Deleted in %s", m.Name)
+    }
+
+    m.generation++
+    for _, uid := range uids {
+        m.forget(uid)
+    }
+    return nil
+}
+
+// expunge exactly the messages in uids, which are marked \Deleted, from
+// the selected mailbox. With UIDPLUS that's UID EXPUNGE. Without it, a
+// plain EXPUNGE would take every other \Deleted message with them, so it's
+// only sent if there aren't any. Returns whether the messages are gone.
+func (m *Mailbox) expunge(c *imap.Client, uids []uint32, set *imap.SeqSet) (bool, error) {
+    if c.Caps["UIDPLUS"] {
+        _, err := imap.Wait(c.Expunge(set))
+        return err == nil, err
+    }
+
+    cmd, err := imap.Wait(c.UIDSearch("DELETED"))
+    if err != nil { return false, err }
+    ours := make(map[uint32]bool, len(uids))
+    for _, uid := range uids {
+        ours[uid] = true
+    }
+    for _, rsp := range cmd.Data {
+        for _, uid := range rsp.SearchResults() {
+            if !ours[uid] {
+                m.server.logf("no UIDPLUS on %s, and %s has other messages marked \\Deleted",
+                    m.server.Hostname, m.Name)
+                return false, nil
+            }
+        }
+    }
+
+    _, err = imap.Wait(c.Expunge(nil))
+    return err == nil, err
+}
+
+// remember how to undo a delete, and make a token for it
+func (s *Server) addUndo(entry *undoEntry) (string, error) {
+    buf := make([]byte, 16)
+    if _, err := rand.Read(buf); err != nil { return "", err }
+    token := hex.EncodeToString(buf)
+
+    if s.undo == nil {
+        s.undo = make(map[string]*undoEntry)
+    }
+    s.expireUndo()
+    s.undo[token] = entry
+    return token, nil
+}
+
+// forget deletes that can no longer be undone
+func (s *Server) expireUndo() {
+    now := time.Now()
+    for token, entry := range s.undo {
+        if now.After(entry.expires) {
+            delete(s.undo, token)
+        }
+    }
+}
+
+// move the messages from a delete back where they came from. Returns the
+// mailbox they were restored to.
+func (s *Server) Undo(token string) (*Mailbox, error) {
+    s.expireUndo()
+    entry, ok := s.undo[token]
+    if !ok {
+        return nil, fmt.Errorf("nothing to undo, or it's too late")
+    }
+
+    uids := entry.uids
+    // look up the messages the server didn't give us UIDs for
+    if len(entry.lost) > 0 {
+        criteria := NewCriteria()
+        for i, id := range entry.lost {
+            if i == 0 {
+                criteria.Header("Message-ID", id)
+            } else {
+                criteria = NewCriteria().Or(criteria, NewCriteria().Header("Message-ID", id))
+            }
+        }
+        found, err := entry.trash.Search(criteria)
+        if err != nil { return nil, err }
+        uids = append(append([]uint32(nil), uids...), found.UIDs...)
+    }
+
+    // the originals never went anywhere. Moving the copies back would
+    // duplicate them, so unmark the originals and expunge the copies.
+    if len(entry.left) > 0 {
+        if err := entry.from.RemoveFlags(entry.left, FlagDeleted); err != nil { return nil, err }
+        if err := entry.from.restore(entry.left); err != nil { return nil, err }
+        if len(uids) > 0 {
+            if err := entry.trash.Expunge(uids); err != nil { return nil, err }
+        }
+        delete(s.undo, token)
+        return entry.from, nil
+    }
+
+    if len(uids) == 0 {
+        return nil, fmt.Errorf("deleted messages are no longer in %s", entry.trash.Name)
+    }
+
+    if _, err := entry.trash.MoveTo(uids, entry.from); err != nil {
+        return nil, err
+    }
+    delete(s.undo, token)
+    return entry.from, nil
+}
+
+// load messages we dropped from the cache back in, like the originals a
+// move left behind. To token holders they're new again.
+func (m *Mailbox) restore(uids []uint32) error {
+    set, err := uidSet(uids)
+    if err != nil { return err }
+    c, err := m.open(true)
+    if err != nil { return err }
+
+    m.generation++
+    for _, uid := range uids {
+        delete(m.removed, uid)
+    }
+    _, err = m.fetchHeaders(c, set)
+    return err
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+func TestUndoAfterMoveLeftOriginals(t *testing.T) {
+    m, f := newFakeMailbox(t, "", 9, func(command string) string {
+        switch {
+        case strings.HasPrefix(command, "LIST "):
+            return "* LIST () \"/\" INBOX\r\n* LIST (\\Trash) \"/\" Trash\r\n"
+        case strings.HasPrefix(command, "UID SEARCH") && strings.HasSuffix(command, " DELETED"):
+            // someone else's message is waiting to be expunged too
+            return "* SEARCH 3 4 9\r\n"
+        case strings.HasPrefix(command, "UID SEARCH"):
+            // the copies in the Trash, by Message-ID
+            return "* SEARCH 20 21\r\n"
+        case strings.HasPrefix(command, "UID FETCH 3:4"):
+            return fetchSummary(3, "", "a", "three", 10) + fetchSummary(4, "", "b", "four", 10)
+        }
+        return ""
+    })
+    defer f.Close()
+    m.server.Mailboxes[m.Name] = m
+    for _, uid := range []uint32{3, 4} {
+        email := threadEmail(uid, fmt.Sprintf("<%d@x>", uid), "")
+        email.server, email.mailbox, email.Flags = m.server, m, []string{}
+        m.Mail[uid] = email
+    }
+
+    token, err := m.Delete([]uint32{3, 4})
+    if err != nil { t.Fatal(err) }
+    if len(m.Mail) != 0 {
+        t.Errorf("%d deleted messages still listed", len(m.Mail))
+    }
+
+    before := len(f.Commands())
+    restored, err := m.server.Undo(token)
+    if err != nil { t.Fatal(err) }
+    if restored != m {
+        t.Errorf("restored to %s", restored.Name)
+    }
+
+    undo := f.Commands()[before:]
+    for _, command := range undo {
+        if strings.HasPrefix(command, "UID COPY") || strings.HasPrefix(command, "UID MOVE") {
+            t.Errorf("undo copied the messages back: %q", command)
+        }
+    }
+    want := []string{`UID STORE 3:4 -FLAGS (\Deleted)`, `UID STORE 20:21 +FLAGS (\Deleted)`}
+    for _, command := range want {
+        if !strings.Contains(strings.Join(undo, "\n"), command) {
+            t.Errorf("undo didn't send %s: %q", command, undo)
+        }
+    }
+    if _, ok := m.Mail[3]; !ok || len(m.Mail) != 2 {
+        t.Errorf("%d messages listed after undo", len(m.Mail))
+    }
+}
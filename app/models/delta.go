@@ -0,0 +1,110 @@
+package models
+
+// incremental mailbox refreshes. Every Update bumps the mailbox's
+// generation; a token names a (UIDVALIDITY, generation) pair, and the
+// delta since a token is everything that happened in later generations.
+
+import (
+    "fmt"
+    "sort"
+)
+
+// what changed in a mailbox between two points in time
+type MailboxDelta struct {
+    // hand this back to Changes to get everything after this delta
+    Token   string
+    // if true, the changes couldn't be computed incrementally.
+    // Added holds every message we know about; forget everything else.
+    Reset   bool
+
+    Added   []*Email
+    Changed []*Email
+    Removed []uint32
+}
+
+// the token describing the mailbox as it is right now
+func (m *Mailbox) Token() string {
+    return fmt.Sprintf("%d.%d", m.UIDValidity, m.generation)
+}
+
+// everything that changed after the given token was issued.
+// an empty or unusable token gets a Reset delta listing the whole cache.
+func (m *Mailbox) Changes(token string) *MailboxDelta {
+    var validity uint32
+    var since uint64
+    n, err := fmt.Sscanf(token, "%d.%d", &validity, &since)
+    if err != nil || n != 2 || validity != m.UIDValidity || since > m.generation {
+        // from the beginning of time
+        return m.changesSince(0)
+    }
+    return m.changesSince(since)
+}
+
+// build the delta of all generations after `since`
+func (m *Mailbox) changesSince(since uint64) *MailboxDelta {
+    delta := &MailboxDelta{
+        Token: m.Token(),
+        Reset: since < m.resetAt || since == 0,
+        Added: make([]*Email, 0),
+        Changed: make([]*Email, 0),
+        Removed: make([]uint32, 0),
+    }
+
+    if delta.Reset {
+        delta.Added = m.Messages()
+        return delta
+    }
+
+    for _, email := range m.Messages() {
+        if email.added > since {
+            delta.Added = append(delta.Added, email)
+        } else if email.changed > since {
+            delta.Changed = append(delta.Changed, email)
+        }
+    }
+
+    for uid, gen := range m.removed {
+        if gen > since {
+            delta.Removed = append(delta.Removed, uid)
+        }
+    }
+    sort.Sort(uidSlice(delta.Removed))
+
+    return delta
+}
+
+// how many expunged UIDs we remember for deltas. Past this, the older half
+// is forgotten, and tokens from before it get a Reset.
+var maxRemoved = 10000
+
+// forget the oldest half (or more) of the expunged UIDs, and stop honouring
+// tokens that would need them
+func (m *Mailbox) pruneRemoved() {
+    gens := make(generations, 0, len(m.removed))
+    for _, gen := range m.removed {
+        gens = append(gens, gen)
+    }
+    sort.Sort(gens)
+    cutoff := gens[len(gens) / 2]
+
+    for uid, gen := range m.removed {
+        if gen <= cutoff {
+            delete(m.removed, uid)
+        }
+    }
+    // a token from the cutoff on needs nothing we dropped
+    if cutoff > m.resetAt {
+        m.resetAt = cutoff
+    }
+}
+
+type generations []uint64
+func (g generations) Len() int           { return len(g) }
+func (g generations) Less(i, j int) bool { return g[i] < g[j] }
+func (g generations) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+
+// sort.Interface for UIDs
+type uidSlice []uint32
+func (s uidSlice) Len() int           { return len(s) }
+func (s uidSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uidSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
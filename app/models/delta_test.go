@@ -0,0 +1,48 @@
+package models
+
+import (
+    "fmt"
+    "testing"
+)
+
+func TestRemovedIsBounded(t *testing.T) {
+    defer func(old int) { maxRemoved = old }(maxRemoved)
+    maxRemoved = 10
+
+    m := &Mailbox{
+        UIDValidity: 1,
+        Mail: make(map[uint32]*Email),
+        removed: make(map[uint32]uint64),
+    }
+    first := m.Token()
+
+    // one message expunged per generation, like Update would
+    tokens := make([]string, 0)
+    for uid := uint32(1); uid <= 25; uid++ {
+        m.generation++
+        m.Mail[uid] = &Email{UID: uid}
+        m.forget(uid)
+        tokens = append(tokens, m.Token())
+    }
+
+    if len(m.removed) > maxRemoved {
+        t.Errorf("%d expunged UIDs remembered, limit %d", len(m.removed), maxRemoved)
+    }
+    if !m.Changes(first).Reset {
+        t.Error("a token from before the pruned removals didn't get a Reset")
+    }
+
+    // recent tokens still get every removal after them
+    recent := tokens[len(tokens) - 3]
+    delta := m.Changes(recent)
+    if delta.Reset || fmt.Sprint(delta.Removed) != "[24 25]" {
+        t.Errorf("Changes(%s) = reset %v, removed %v", recent, delta.Reset, delta.Removed)
+    }
+    for i, token := range tokens {
+        delta := m.Changes(token)
+        if delta.Reset { continue }
+        if len(delta.Removed) != len(tokens) - 1 - i {
+            t.Errorf("Changes(%s) removed %v", token, delta.Removed)
+        }
+    }
+}
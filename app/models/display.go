@@ -0,0 +1,190 @@
+package models
+
+// deciding which parts of a message a reader actually sees, so clients
+// don't each have to walk the MIME tree themselves.
+
+import (
+    "strings"
+)
+
+// MIME type of plain text parts
+const TypePlain = "text/plain"
+
+// what to show for a message: the parts to render in order, and the
+// attachments to offer for download
+type Display struct {
+    Body        []*DisplayPart
+    Attachments []*MessageNode
+}
+
+// one thing to render
+type DisplayPart struct {
+    // a text/plain or text/html part, an inline image, or an attached
+    // message, whose header goes here and whose parts follow
+    Part    *MessageNode
+    // a text Part ready to show: safe HTML if HTML was preferred, and
+    // plain text (unflowed, or converted from HTML) if not
+    HTML    string `json:",omitempty"`
+    Text    string `json:",omitempty"`
+    // the rest of the multipart/related Part is the root of. The HTML
+    // refers to these by cid:, they aren't shown on their own
+    Related []*MessageNode `json:",omitempty"`
+}
+
+// pick out the parts of this tree to show. For multipart/alternative the
+// best part we can render is chosen, HTML if preferHTML, otherwise plain
+// text; parts of a multipart/related stay together; inline parts of a
+// multipart/mixed are shown in order, and attachments are listed apart.
+// Text parts are rendered the preferred way whatever they were sent as,
+// so they should have their Bodies loaded first.
+func (node *MessageNode) DisplayParts(preferHTML bool) *Display {
+    display := &Display{
+        Body: make([]*DisplayPart, 0),
+        Attachments: make([]*MessageNode, 0),
+    }
+    display.add(node, preferHTML)
+    return display
+}
+
+func (d *Display) add(node *MessageNode, preferHTML bool) {
+    switch {
+    case node.IsAttachment():
+        d.Attachments = append(d.Attachments, node)
+
+    case IsMessageType(node.ContentType):
+        d.Body = append(d.Body, &DisplayPart{Part: node})
+        for _, child := range node.Children {
+            d.add(child, preferHTML)
+        }
+
+    case node.ContentType == "multipart/alternative":
+        if best := bestAlternative(node.Children, preferHTML); best != nil {
+            d.add(best, preferHTML)
+        }
+
+    case node.ContentType == "multipart/related":
+        d.addRelated(node, preferHTML)
+
+    case node.Children != nil:
+        // multipart/mixed, and anything we don't know is treated like it
+        for _, child := range node.Children {
+            d.add(child, preferHTML)
+        }
+
+    case renderable(node):
+        d.Body = append(d.Body, renderPart(node, preferHTML))
+
+    case node.Inline:
+        // an image some HTML part already shows
+
+    default:
+        d.Attachments = append(d.Attachments, node)
+    }
+}
+
+// a part to show, with text rendered as HTML or plain text. Images are
+// shown as they are.
+func renderPart(node *MessageNode, preferHTML bool) *DisplayPart {
+    part := &DisplayPart{Part: node}
+    if strings.HasPrefix(node.ContentType, "image/") { return part }
+
+    var err error
+    if preferHTML {
+        part.HTML, err = node.HTML()
+    } else {
+        part.Text, err = node.PlainText()
+    }
+    if err != nil {
+        debug("could not render part ", node.Section, ": ", err)
+    }
+    return part
+}
+
+// a multipart/related is its root part - the one named by the start
+// parameter, or the first - plus the parts the root refers to
+func (d *Display) addRelated(node *MessageNode, preferHTML bool) {
+    if len(node.Children) == 0 { return }
+
+    root := node.Children[0]
+    if start := strings.Trim(node.ContentTypeParams["start"], "<>"); start != "" {
+        for _, child := range node.Children {
+            if child.ContentID() == start {
+                root = child
+                break
+            }
+        }
+    }
+
+    related := make([]*MessageNode, 0, len(node.Children) - 1)
+    for _, child := range node.Children {
+        if child == root { continue }
+        // some senders put real attachments in here too
+        if child.IsAttachment() {
+            d.Attachments = append(d.Attachments, child)
+        } else {
+            related = append(related, child)
+        }
+    }
+
+    // the root is usually text/html, but may itself be an alternative
+    first := len(d.Body)
+    d.add(root, preferHTML)
+    if first < len(d.Body) {
+        d.Body[first].Related = related
+    }
+}
+
+// the alternative to show. RFC 2046 says they're in increasing order of
+// faithfulness to the original, so the last one we can render wins,
+// unless it's the wrong kind of text.
+func bestAlternative(alternatives []*MessageNode, preferHTML bool) *MessageNode {
+    var best, fallback *MessageNode
+    for _, alt := range alternatives {
+        if !alt.hasRenderable() { continue }
+        fallback = alt
+        if alt.contains(TypeHTML) == preferHTML {
+            best = alt
+        }
+    }
+    if best == nil {
+        return fallback
+    }
+    return best
+}
+
+// can we show this leaf ourselves?
+func renderable(node *MessageNode) bool {
+    if node.Children != nil || node.Inline { return false }
+    switch {
+    case node.ContentType == TypePlain, node.ContentType == TypeHTML:
+        return true
+    // no Content-Type means text/plain
+    case node.ContentType == "":
+        return true
+    case strings.HasPrefix(node.ContentType, "image/"):
+        return node.ContentType != "image/svg+xml"
+    }
+    return false
+}
+
+// does this part, or any under it, have something we can show?
+func (node *MessageNode) hasRenderable() bool {
+    found := false
+    node.ForEach(func(part *MessageNode) {
+        if renderable(part) && !part.IsAttachment() {
+            found = true
+        }
+    })
+    return found
+}
+
+// does this part, or any under it, have a MIME type?
+func (node *MessageNode) contains(contentType string) bool {
+    found := false
+    node.ForEach(func(part *MessageNode) {
+        if part.ContentType == contentType {
+            found = true
+        }
+    })
+    return found
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+    "strings"
+    "testing"
+)
+
+// a part of a multipart with boundary b
+func displayPart(header, body string) string {
+    return "--b\r\n" + header + "\r\n\r\n" + body + "\r\n"
+}
+
+func TestDisplayParts(t *testing.T) {
+    plain := displayPart("Content-Type: text/plain", "plain")
+    html := displayPart("Content-Type: text/html", "<p>html</p>")
+    alternative := "Content-Type: multipart/alternative; boundary=b\r\n\r\n" + plain + html + "--b--\r\n"
+    pdf := displayPart("Content-Type: application/pdf\r\nContent-Disposition: attachment; filename=a.pdf", "PDF")
+
+    tests := []struct {
+        name       string
+        raw        string
+        preferHTML bool
+        // the Body parts, as type(content), and what they refer to
+        body       []string
+        related    []string
+        // the Attachments' filenames
+        attached   []string
+    }{
+        {"alternative, HTML", alternative, true, []string{"text/html(<p>html</p>)"}, nil, nil},
+        {"alternative, plain", alternative, false, []string{"text/plain(plain)"}, nil, nil},
+        {"alternative, only HTML", "Content-Type: multipart/alternative; boundary=b\r\n\r\n" + html + "--b--\r\n",
+            false, []string{"text/html(<p>html</p>)"}, nil, nil},
+        {
+            "related with start",
+            "Content-Type: multipart/related; boundary=b; start=\"<root@x>\"\r\n\r\n" +
+                displayPart("Content-Type: image/png\r\nContent-Id: <img@x>", "PNG") +
+                displayPart("Content-Type: text/html\r\nContent-Id: <root@x>", `<img src="cid:img@x">`) +
+                pdf + "--b--\r\n",
+            true,
+            []string{`text/html(<img src="cid:img@x">)`},
+            []string{"image/png(PNG)"},
+            []string{"a.pdf"},
+        },
+        {
+            "related without start",
+            "Content-Type: multipart/related; boundary=b\r\n\r\n" +
+                displayPart("Content-Type: text/html", `<img src="cid:img@x">`) +
+                displayPart("Content-Type: image/png\r\nContent-Id: <img@x>", "PNG") + "--b--\r\n",
+            true,
+            []string{`text/html(<img src="cid:img@x">)`},
+            []string{"image/png(PNG)"},
+            nil,
+        },
+        {
+            "mixed in order",
+            "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+                displayPart("Content-Type: text/plain", "one") + pdf +
+                displayPart("Content-Type: image/jpeg\r\nContent-Disposition: inline", "JPEG") +
+                displayPart("Content-Type: text/plain", "two") + "--b--\r\n",
+            false,
+            []string{"text/plain(one)", "image/jpeg(JPEG)", "text/plain(two)"},
+            nil,
+            []string{"a.pdf"},
+        },
+    }
+
+    for _, test := range tests {
+        node, err := ParseMessage(strings.NewReader(test.raw), ParseLimits{})
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        display := node.DisplayParts(test.preferHTML)
+
+        body, related := make([]string, 0), make([]string, 0)
+        for _, part := range display.Body {
+            body = append(body, describePart(part.Part))
+            for _, r := range part.Related {
+                related = append(related, describePart(r))
+            }
+
+            // text is rendered the way that was asked for
+            if strings.HasPrefix(part.Part.ContentType, "text/") {
+                if test.preferHTML && (part.HTML == "" || part.Text != "") ||
+                    !test.preferHTML && (part.Text == "" || part.HTML != "") {
+                    t.Errorf("%s: %s rendered as HTML %q, text %q", test.name, part.Part.ContentType, part.HTML, part.Text)
+                }
+            }
+        }
+        attached := make([]string, 0)
+        for _, part := range display.Attachments {
+            attached = append(attached, part.Filename)
+        }
+
+        if strings.Join(body, " ") != strings.Join(test.body, " ") {
+            t.Errorf("%s: body %q, want %q", test.name, body, test.body)
+        }
+        if strings.Join(related, " ") != strings.Join(test.related, " ") {
+            t.Errorf("%s: related %q, want %q", test.name, related, test.related)
+        }
+        if strings.Join(attached, " ") != strings.Join(test.attached, " ") {
+            t.Errorf("%s: attachments %q, want %q", test.name, attached, test.attached)
+        }
+        node.Close()
+    }
+}
+
+// type(content)
+func describePart(node *MessageNode) string {
+    data := []byte{}
+    if node.Body != nil {
+        data, _ = node.Body.Data()
+    }
+    return node.ContentType + "(" + string(data) + ")"
+}
@@ -0,0 +1,124 @@
+package models
+
+// undoing Content-Transfer-Encoding (RFC 2045 section 6) on part bodies
+
+import (
+    "bytes"
+    "encoding/base64"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "mime/quotedprintable"
+    "strings"
+)
+
+// MIME header for a part's transfer encoding
+const ContentTransferEncoding = "Content-Transfer-Encoding"
+
+// transfer encodings
+const (
+    Encoding7Bit            = "7bit"
+    Encoding8Bit            = "8bit"
+    EncodingBinary          = "binary"
+    EncodingQuotedPrintable = "quoted-printable"
+    EncodingBase64          = "base64"
+)
+
+// the transfer encoding named in a header, lowercased. RFC 2045 says no
+// header means 7bit
+func transferEncoding(header map[string][]string) string {
+    values := header[ContentTransferEncoding]
+    if len(values) == 0 { return Encoding7Bit }
+    encoding := strings.ToLower(strings.TrimSpace(values[0]))
+    if encoding == "" { return Encoding7Bit }
+    return encoding
+}
+
+// decode data in the given transfer encoding. Mail in the wild is often a
+// little broken, so as much as can be decoded is returned along with any
+// error. Unknown encodings are an error, and the data is returned as-is.
+func decodeTransfer(encoding string, data []byte) ([]byte, error) {
+    switch encoding {
+    case Encoding7Bit, Encoding8Bit, EncodingBinary:
+        return data, nil
+
+    case EncodingQuotedPrintable:
+        return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+
+    case EncodingBase64:
+        return decodeBase64(data)
+    }
+
+    return data, fmt.Errorf("unknown Content-Transfer-Encoding %q", encoding)
+}
+
+// base64 with the line breaks and other junk mailers put in it.
+// whatever's left over at the end (a truncated preview, say) is dropped.
+func decodeBase64(data []byte) ([]byte, error) {
+    clean := make([]byte, 0, len(data))
+    for _, c := range data {
+        if base64Char(c) {
+            clean = append(clean, c)
+        }
+    }
+
+    // padding is optional; decode whole 4-character groups and then the rest
+    whole := len(clean) / 4 * 4
+    out := make([]byte, base64.StdEncoding.DecodedLen(whole), len(clean) * 3 / 4 + 3)
+    n, err := base64.StdEncoding.Decode(out, clean[:whole])
+    if err != nil { return out[:n], err }
+    out = out[:n]
+
+    if rest := clean[whole:]; len(rest) > 1 {
+        tail, err := base64.RawStdEncoding.DecodeString(string(rest))
+        if err != nil { return out, err }
+        out = append(out, tail...)
+    }
+    return out, nil
+}
+
+// is this byte in the base64 alphabet? padding isn't
+func base64Char(c byte) bool {
+    return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+        c == '+' || c == '/'
+}
+
+// a reader that undoes a transfer encoding as it goes, for parts too big
+// to decode in memory. ok is false for encodings we don't know, which are
+// read as-is.
+func decodingReader(encoding string, r io.Reader) (decoded io.Reader, ok bool) {
+    switch encoding {
+    case Encoding7Bit, Encoding8Bit, EncodingBinary:
+        return r, true
+
+    case EncodingQuotedPrintable:
+        return quotedprintable.NewReader(r), true
+
+    case EncodingBase64:
+        return base64.NewDecoder(base64.StdEncoding, base64Filter{r}), true
+    }
+    return r, false
+}
+
+// drops line breaks and other junk from base64, so the stream decoder
+// only sees the alphabet and padding
+type base64Filter struct {
+    r io.Reader
+}
+
+func (f base64Filter) Read(p []byte) (int, error) {
+    for {
+        n, err := f.r.Read(p)
+        kept := 0
+        for _, c := range p[:n] {
+            if base64Char(c) || c == '=' {
+                p[kept] = c
+                kept++
+            }
+        }
+        // a read of nothing but junk isn't the end
+        if kept > 0 || err != nil {
+            return kept, err
+        }
+    }
+}
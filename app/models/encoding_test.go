@@ -0,0 +1,36 @@
+package models
+
+import (
+    "testing"
+)
+
+func TestDecodeTransfer(t *testing.T) {
+    tests := []struct {
+        name     string
+        encoding string
+        in       string
+        want     string
+        wantErr  bool
+    }{
+        {"7bit", Encoding7Bit, "hello\r\n", "hello\r\n", false},
+        {"quoted-printable", EncodingQuotedPrintable, "caf=C3=A9 =\r\nbar", "café bar", false},
+        {"base64", EncodingBase64, "aGVsbG8gd29ybGQ=", "hello world", false},
+        {"base64 line breaks", EncodingBase64, "aGVs\r\nbG8g\r\nd29y\r\nbGQ=\r\n", "hello world", false},
+        {"base64 junk", EncodingBase64, "aGVs*bG8-\x00gd29y bGQ=", "hello world", false},
+        {"base64 missing padding", EncodingBase64, "aGVsbG8gd29ybGQ", "hello world", false},
+        {"base64 two missing", EncodingBase64, "aGVsbG8gd29ybA", "hello worl", false},
+        {"base64 truncated tail", EncodingBase64, "aGVsbG8gd", "hello ", false},
+        {"base64 empty", EncodingBase64, "", "", false},
+        {"unknown", "x-uuencode", "begin 644 a", "begin 644 a", true},
+    }
+
+    for _, test := range tests {
+        out, err := decodeTransfer(test.encoding, []byte(test.in))
+        if (err != nil) != test.wantErr {
+            t.Errorf("%s: error %v", test.name, err)
+        }
+        if string(out) != test.want {
+            t.Errorf("%s: got %q, want %q", test.name, out, test.want)
+        }
+    }
+}
@@ -0,0 +1,129 @@
+package models
+
+// the typed message summary the list view needs, built from ENVELOPE,
+// INTERNALDATE, RFC822.SIZE and BODYSTRUCTURE instead of parsing every
+// header of every message.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "net/mail"
+    "strings"
+    "time"
+)
+
+// an address from an ENVELOPE
+type Address struct {
+    Name    string
+    Mailbox string
+    Host    string
+}
+
+// user@host
+func (a *Address) Address() string {
+    if a.Host == "" { return a.Mailbox }
+    return a.Mailbox + "@" + a.Host
+}
+
+// Name <user@host>, or just the address if there's no name
+func (a *Address) String() string {
+    addr := &mail.Address{Name: a.Name, Address: a.Address()}
+    return addr.String()
+}
+
+// the parsed ENVELOPE of a message: its important headers, as the server
+// understood them
+type Envelope struct {
+    Date      time.Time
+    Subject   string
+    From      []*Address
+    Sender    []*Address
+    ReplyTo   []*Address
+    To        []*Address
+    Cc        []*Address
+    Bcc       []*Address
+    InReplyTo string
+    MessageID string
+}
+
+// everything the message list needs to know about a message
+type Summary struct {
+    Envelope
+    // message IDs from the References header, for threading
+    References     []string
+    // when the message arrived in the mailbox
+    InternalDate   time.Time
+    // size of the whole message in bytes
+    Size           uint32
+    // does the message have any parts that are real attachments?
+    HasAttachments bool
+}
+
+// parse an ENVELOPE response field. See RFC 3501 section 7.4.2
+func parseEnvelope(f imap.Field) *Envelope {
+    fields := imap.AsList(f)
+    if len(fields) < 10 { return nil }
+
+    env := &Envelope{
+        Subject:   DecodeHeader(imap.AsString(fields[1])),
+        From:      parseAddresses(fields[2]),
+        Sender:    parseAddresses(fields[3]),
+        ReplyTo:   parseAddresses(fields[4]),
+        To:        parseAddresses(fields[5]),
+        Cc:        parseAddresses(fields[6]),
+        Bcc:       parseAddresses(fields[7]),
+        InReplyTo: imap.AsString(fields[8]),
+        MessageID: imap.AsString(fields[9]),
+    }
+
+    // the date is the raw Date header
+    if date := imap.AsString(fields[0]); date != "" {
+        header := mail.Header{"Date": {date}}
+        if t, err := header.Date(); err == nil {
+            env.Date = t
+        }
+    }
+
+    return env
+}
+
+// parse an address list from an ENVELOPE. Each address is
+// (name adl mailbox host); group markers have a NIL host and are skipped.
+func parseAddresses(f imap.Field) []*Address {
+    addrs := make([]*Address, 0)
+    for _, a := range imap.AsList(f) {
+        parts := imap.AsList(a)
+        if len(parts) < 4 || parts[3] == nil { continue }
+        addrs = append(addrs, &Address{
+            Name:    DecodeHeader(imap.AsString(parts[0])),
+            Mailbox: imap.AsString(parts[2]),
+            Host:    imap.AsString(parts[3]),
+        })
+    }
+    return addrs
+}
+
+// build a summary from a FETCH of listItems. structure is its parsed
+// BODYSTRUCTURE, or nil
+func parseSummary(info *imap.MessageInfo, structure *BodyStructure) *Summary {
+    summary := &Summary{
+        InternalDate: info.InternalDate,
+        Size: info.Size,
+        References: make([]string, 0),
+    }
+
+    if env := parseEnvelope(info.Attrs["ENVELOPE"]); env != nil {
+        summary.Envelope = *env
+    }
+
+    if structure != nil {
+        summary.HasAttachments = structure.HasAttachments()
+    }
+
+    // "References: <a@b> <c@d>" from BODY[HEADER.FIELDS (REFERENCES)]
+    refs := imap.AsBytes(info.Attrs[referencesItem])
+    if msg, _ := mail.ReadMessage(strings.NewReader(string(refs) + "\r\n")); msg != nil {
+        summary.References = messageIDs.FindAllString(msg.Header.Get("References"), -1)
+    }
+
+    return summary
+}
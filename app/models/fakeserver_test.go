@@ -0,0 +1,143 @@
+package models
+
+import (
+    "bufio"
+    "code.google.com/p/go-imap/go1/imap"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// an IMAP server for tests. It records every command the client sends,
+// without its tag, and answers each one with whatever reply returns for it
+// followed by a tagged OK.
+type fakeServer struct {
+    reply    func(command string) string
+    // ends the connection, or stops listening
+    closer   io.Closer
+
+    mu       sync.Mutex
+    commands []string
+}
+
+// a client that's already authenticated to a fakeServer with caps, on the
+// other end of a pipe
+func newFakeServer(t *testing.T, caps string, reply func(command string) string) (*imap.Client, *fakeServer) {
+    client, server := net.Pipe()
+    f := &fakeServer{reply: reply, closer: server}
+    go f.serve(server, "PREAUTH", caps)
+
+    c, err := imap.NewClient(client, "fake", time.Second)
+    if err != nil { t.Fatal(err) }
+    return c, f
+}
+
+// a Server that connects to a fakeServer on a local port, and has to log in
+func listenFakeServer(t *testing.T, caps string, reply func(command string) string) (*Server, *fakeServer) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    f := &fakeServer{reply: reply, closer: listener}
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil { return }
+            go f.serve(conn, "OK", caps)
+        }
+    }()
+
+    s := NewServer(listener.Addr().String(), "user", "password")
+    s.UseTLS = false
+    return s, f
+}
+
+func (f *fakeServer) serve(conn net.Conn, greeting, caps string) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    fmt.Fprintf(conn, "* %s [CAPABILITY %s] ready\r\n", greeting, strings.TrimSpace("IMAP4rev1 " + caps))
+    for {
+        line, err := readCommand(conn, r)
+        if err != nil { return }
+        tag, command := line, ""
+        if i := strings.IndexByte(line, ' '); i >= 0 {
+            tag, command = line[:i], line[i+1:]
+        }
+
+        f.mu.Lock()
+        f.commands = append(f.commands, command)
+        f.mu.Unlock()
+
+        out := ""
+        if f.reply != nil {
+            out = f.reply(command)
+        }
+        if command == "LOGOUT" {
+            fmt.Fprintf(conn, "* BYE\r\n%s OK done\r\n", tag)
+            return
+        }
+        fmt.Fprintf(conn, "%s%s OK done\r\n", out, tag)
+    }
+}
+
+// one command line, with any literals in it read inline
+func readCommand(conn net.Conn, r *bufio.Reader) (string, error) {
+    command := ""
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil { return "", err }
+        line = strings.TrimRight(line, "\r\n")
+        command += line
+
+        open := strings.LastIndex(line, "{")
+        if open < 0 || !strings.HasSuffix(line, "}") { return command, nil }
+        n, err := strconv.Atoi(line[open + 1:len(line) - 1])
+        if err != nil { return command, nil }
+
+        fmt.Fprint(conn, "+ go ahead\r\n")
+        literal := make([]byte, n)
+        if _, err := io.ReadFull(r, literal); err != nil { return "", err }
+        command += "\n" + string(literal)
+    }
+}
+
+// the commands the client has sent so far
+func (f *fakeServer) Commands() []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return append([]string(nil), f.commands...)
+}
+
+func (f *fakeServer) Close() {
+    f.closer.Close()
+}
+
+// a mailbox on a fakeServer that nothing has been loaded from yet. SELECT
+// and EXAMINE find n messages with UIDVALIDITY 1; reply answers the rest.
+func newFakeMailbox(t *testing.T, caps string, n int, reply func(command string) string) (*Mailbox, *fakeServer) {
+    c, f := newFakeServer(t, caps, func(command string) string {
+        if strings.HasPrefix(command, "SELECT ") || strings.HasPrefix(command, "EXAMINE ") {
+            return fmt.Sprintf("* %d EXISTS\r\n* OK [UIDVALIDITY 1] ok\r\n* OK [UIDNEXT %d] ok\r\n", n, n + 1)
+        }
+        if reply == nil { return "" }
+        return reply(command)
+    })
+
+    s := NewServer("fake", "user", "password")
+    s.client = c
+    s.disconnectTimer = time.NewTimer(time.Hour)
+    // as Connect would
+    if err := s.enableExtensions(c); err != nil { t.Fatal(err) }
+    return NewMailbox("INBOX", s), f
+}
+
+// an untagged FETCH with the ENVELOPE and size of a message, as its
+// sequence number and UID
+func fetchSummary(uid uint32, date, from, subject string, size int) string {
+    return fmt.Sprintf("* %d FETCH (UID %d FLAGS () RFC822.SIZE %d " +
+        "ENVELOPE (%q %q ((NIL NIL %q \"x\")) NIL NIL NIL NIL NIL NIL \"<%d@x>\"))\r\n",
+        uid, uid, size, date, subject, from, uid)
+}
@@ -0,0 +1,120 @@
+package models
+
+// message flags: reading them off FETCH responses, and changing them with
+// UID STORE.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// system flags defined by RFC 3501
+const (
+    FlagSeen     = `\Seen`
+    FlagAnswered = `\Answered`
+    FlagFlagged  = `\Flagged`
+    FlagDeleted  = `\Deleted`
+    FlagDraft    = `\Draft`
+)
+
+// characters that can't appear in a flag or keyword atom
+const flagSpecials = "(){ %*\"]"
+
+// turn a go-imap FlagSet into a sorted list, which is nicer in JSON
+func flagList(flags imap.FlagSet) []string {
+    list := make([]string, 0, len(flags))
+    for flag := range flags {
+        list = append(list, flag)
+    }
+    sort.Strings(list)
+    return list
+}
+
+// compare two sorted flag lists
+func flagsEqual(a, b []string) bool {
+    if len(a) != len(b) { return false }
+    for i := range a {
+        if a[i] != b[i] { return false }
+    }
+    return true
+}
+
+// make sure flags can be sent to the server as atoms.
+// \Recent can't be set by clients.
+func checkFlags(flags []string) error {
+    for _, flag := range flags {
+        if flag == "" || strings.ContainsAny(flag, flagSpecials) {
+            return fmt.Errorf("invalid flag %q", flag)
+        }
+        // only system flags start with a backslash, and only once
+        if strings.Contains(flag[1:], `\`) {
+            return fmt.Errorf("invalid flag %q", flag)
+        }
+        if strings.EqualFold(flag, `\Recent`) {
+            return fmt.Errorf("the \\Recent flag cannot be changed")
+        }
+        for _, c := range flag {
+            if c <= ' ' || c >= 0x7f {
+                return fmt.Errorf("invalid flag %q", flag)
+            }
+        }
+    }
+    return nil
+}
+
+// build a UID set for a list of UIDs
+func uidSet(uids []uint32) (*imap.SeqSet, error) {
+    if len(uids) == 0 {
+        return nil, fmt.Errorf("no messages given")
+    }
+    set := &imap.SeqSet{}
+    set.AddNum(uids...)
+    return set, nil
+}
+
+// replace the flags on a set of messages
+func (m *Mailbox) SetFlags(uids []uint32, flags ...string) error {
+    return m.storeFlags(uids, "FLAGS", flags)
+}
+
+// add flags to a set of messages
+func (m *Mailbox) AddFlags(uids []uint32, flags ...string) error {
+    return m.storeFlags(uids, "+FLAGS", flags)
+}
+
+// remove flags from a set of messages
+func (m *Mailbox) RemoveFlags(uids []uint32, flags ...string) error {
+    return m.storeFlags(uids, "-FLAGS", flags)
+}
+
+// issue a UID STORE and apply the resulting flags to our cache.
+// The server answers with the new FLAGS for each message, so we don't use
+// .SILENT
+func (m *Mailbox) storeFlags(uids []uint32, item string, flags []string) error {
+    if err := checkFlags(flags); err != nil { return err }
+
+    set, err := uidSet(uids)
+    if err != nil { return err }
+
+    c, err := m.open(false)
+    if err != nil { return err }
+    if c.Mailbox.ReadOnly {
+        return fmt.Errorf("mailbox %s is read-only", m.Name)
+    }
+
+    cmd, err := imap.Wait(c.UIDStore(set, item, imap.NewFlagSet(flags...)))
+    if err != nil { return err }
+
+    // changes made by us count as changes for anyone holding a token
+    m.generation++
+    for _, rsp := range cmd.Data {
+        info := rsp.MessageInfo()
+        if email, ok := m.Mail[info.UID]; ok && info.Attrs["FLAGS"] != nil {
+            email.updateFlags(info.Flags)
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,212 @@
+package models
+
+// decoding non-ASCII header text: encoded-words like =?UTF-8?B?...?=
+// (RFC 2047) and parameters like filename*0*=utf-8''%E2%82%AC (RFC 2231)
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "mime"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// decodes encoded-words in any charset we know about
+var wordDecoder = &mime.WordDecoder{
+    CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+        enc := lookupCharset(charset)
+        if enc == nil {
+            return nil, fmt.Errorf("unknown charset %q", charset)
+        }
+        return enc.NewDecoder().Reader(input), nil
+    },
+}
+
+// decode any RFC 2047 encoded-words in a header value. If that fails the
+// value is returned as it was.
+func DecodeHeader(value string) string {
+    decoded, err := wordDecoder.DecodeHeader(value)
+    if err != nil { return value }
+    return decoded
+}
+
+// parse a Content-Type or Content-Disposition value. Like
+// mime.ParseMediaType, but RFC 2231 parameters in any charset are decoded,
+// encoded-words in parameters (which mailers use even though they
+// shouldn't) are too, and a broken parameter doesn't lose the rest.
+func parseMediaType(value string) (string, map[string]string, error) {
+    parts := splitParams(value)
+    mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+    if mediaType == "" {
+        return "", nil, fmt.Errorf("no media type in %q", value)
+    }
+
+    raw := make(map[string]string)
+    for _, param := range parts[1:] {
+        eq := strings.Index(param, "=")
+        if eq < 0 { continue }
+        key := strings.ToLower(strings.TrimSpace(param[:eq]))
+        if key == "" { continue }
+        raw[key] = unquote(strings.TrimSpace(param[eq + 1:]))
+    }
+
+    return mediaType, decodeParams(raw), nil
+}
+
+// split a header value on semicolons that aren't inside quotes
+func splitParams(value string) []string {
+    parts := make([]string, 0, 2)
+    var current bytes.Buffer
+    quoted, escaped := false, false
+    for _, c := range value {
+        switch {
+        case escaped:
+            escaped = false
+        case c == '\\' && quoted:
+            escaped = true
+        case c == '"':
+            quoted = !quoted
+        case c == ';' && !quoted:
+            parts = append(parts, current.String())
+            current.Reset()
+            continue
+        }
+        current.WriteRune(c)
+    }
+    return append(parts, current.String())
+}
+
+// remove the quotes and backslash escapes from a quoted-string
+func unquote(s string) string {
+    if len(s) < 2 || s[0] != '"' || s[len(s) - 1] != '"' {
+        return s
+    }
+    s = s[1:len(s) - 1]
+    var out bytes.Buffer
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\\' && i + 1 < len(s) {
+            i++
+        }
+        out.WriteByte(s[i])
+    }
+    return out.String()
+}
+
+// one piece of an RFC 2231 parameter: name*N or name*N*
+type paramSegment struct {
+    index    int
+    value    string
+    extended bool
+}
+
+// put RFC 2231 continuations back together and decode them, and decode
+// encoded-words in plain values. Keys must already be lowercase.
+func decodeParams(raw map[string]string) map[string]string {
+    params := make(map[string]string)
+    segments := make(map[string][]paramSegment)
+
+    for key, value := range raw {
+        star := strings.Index(key, "*")
+        if star < 0 {
+            params[key] = DecodeHeader(value)
+            continue
+        }
+
+        name, rest := key[:star], key[star + 1:]
+        seg := paramSegment{value: value}
+        switch {
+        case rest == "":
+            // name*=charset'lang'value
+            seg.extended = true
+        default:
+            seg.extended = strings.HasSuffix(rest, "*")
+            n, err := strconv.Atoi(strings.TrimSuffix(rest, "*"))
+            if err != nil { continue }
+            seg.index = n
+        }
+        segments[name] = append(segments[name], seg)
+    }
+
+    for name, segs := range segments {
+        sort.Sort(byParamIndex(segs))
+
+        // the charset comes from the first segment, if it's extended
+        charset := ""
+        var value bytes.Buffer
+        for i, seg := range segs {
+            if !seg.extended {
+                value.WriteString(seg.value)
+                continue
+            }
+            text := seg.value
+            if i == 0 {
+                // charset'language'text
+                if quotes := strings.SplitN(text, "'", 3); len(quotes) == 3 {
+                    charset, text = quotes[0], quotes[2]
+                }
+            }
+            if unescaped, err := url.PathUnescape(text); err == nil {
+                text = unescaped
+            }
+            value.WriteString(text)
+        }
+
+        // the extended version wins over a plain one sent for old clients
+        params[name] = string(toUTF8(charset, value.Bytes()))
+    }
+
+    return params
+}
+
+type byParamIndex []paramSegment
+
+func (s byParamIndex) Len() int           { return len(s) }
+func (s byParamIndex) Less(i, j int) bool { return s[i].index < s[j].index }
+func (s byParamIndex) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//////// accessors ////////
+
+// a header of this part with encoded-words decoded. Header keeps the raw
+// values.
+func (node *MessageNode) DecodedHeader(name string) string {
+    return DecodeHeader(node.Header.Get(name))
+}
+
+// the decoded Subject header
+func (node *MessageNode) Subject() string {
+    return node.DecodedHeader("Subject")
+}
+
+// the name of this part as a file, from Content-Disposition or the older
+// Content-Type name parameter. "" if it has none.
+func (node *MessageNode) filename() string {
+    if _, params, err := parseMediaType(node.Header.Get("Content-Disposition")); err == nil {
+        if name := params["filename"]; name != "" {
+            return name
+        }
+    }
+    return node.ContentTypeParams["name"]
+}
+
+// the decoded subject of this message
+func (m *Email) Subject() string {
+    if m.Summary != nil {
+        return m.Summary.Subject
+    }
+    if m.Message != nil {
+        return m.Message.Subject()
+    }
+    return ""
+}
+
+// a decoded header of this message. Only headers in the ENVELOPE are
+// available until the message has been opened with Structure or Body.
+func (m *Email) DecodedHeader(name string) string {
+    if m.Message != nil {
+        return m.Message.DecodedHeader(name)
+    }
+    return ""
+}
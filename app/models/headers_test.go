@@ -0,0 +1,122 @@
+package models
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseMediaType(t *testing.T) {
+    tests := []struct {
+        name      string
+        value     string
+        mediaType string
+        params    map[string]string
+    }{
+        {"plain", "text/plain; charset=utf-8", "text/plain", map[string]string{"charset": "utf-8"}},
+        {"case", "TEXT/HTML; CHARSET=UTF-8", "text/html", map[string]string{"charset": "UTF-8"}},
+        {
+            "continuations",
+            "application/pdf; filename*0*=utf-8''%E2%82%AC; filename*1=.pdf",
+            "application/pdf",
+            map[string]string{"filename": "€.pdf"},
+        },
+        {
+            "continuations out of order",
+            `application/pdf; filename*1="b.pdf"; filename*0="a"`,
+            "application/pdf",
+            map[string]string{"filename": "ab.pdf"},
+        },
+        {
+            "extended wins over plain",
+            `attachment; filename="fallback.pdf"; filename*=utf-8''%E2%82%AC.pdf`,
+            "attachment",
+            map[string]string{"filename": "€.pdf"},
+        },
+        {
+            "extended in another charset",
+            "attachment; filename*=iso-8859-1'en'caf%E9.txt",
+            "attachment",
+            map[string]string{"filename": "café.txt"},
+        },
+        {
+            "quoted semicolon",
+            `text/plain; name="a;b.txt"; charset=us-ascii`,
+            "text/plain",
+            map[string]string{"name": "a;b.txt", "charset": "us-ascii"},
+        },
+        {
+            "escaped quote",
+            `text/plain; name="say \"hi\"; ok"`,
+            "text/plain",
+            map[string]string{"name": `say "hi"; ok`},
+        },
+        {
+            "encoded-word",
+            `application/pdf; name="=?UTF-8?B?4oKs?="`,
+            "application/pdf",
+            map[string]string{"name": "€"},
+        },
+        {
+            "broken parameter",
+            "text/plain; junk; charset=utf-8",
+            "text/plain",
+            map[string]string{"charset": "utf-8"},
+        },
+    }
+
+    for _, test := range tests {
+        mediaType, params, err := parseMediaType(test.value)
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+        if mediaType != test.mediaType {
+            t.Errorf("%s: type %q, want %q", test.name, mediaType, test.mediaType)
+        }
+        if !reflect.DeepEqual(params, test.params) {
+            t.Errorf("%s: params %q, want %q", test.name, params, test.params)
+        }
+    }
+
+    if _, _, err := parseMediaType("; charset=utf-8"); err == nil {
+        t.Errorf("no media type: no error")
+    }
+}
+
+func TestSplitParams(t *testing.T) {
+    tests := []struct {
+        value string
+        want  []string
+    }{
+        {"text/plain", []string{"text/plain"}},
+        {"text/plain; a=1; b=2", []string{"text/plain", " a=1", " b=2"}},
+        {`text/plain; a="x;y"; b=2`, []string{"text/plain", ` a="x;y"`, " b=2"}},
+        {`text/plain; a="x\";y"; b=2`, []string{"text/plain", ` a="x\";y"`, " b=2"}},
+        {"text/plain;", []string{"text/plain", ""}},
+    }
+
+    for _, test := range tests {
+        if got := splitParams(test.value); !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%q: got %q, want %q", test.value, got, test.want)
+        }
+    }
+}
+
+// BODYSTRUCTURE hands us the parameters already split
+func TestDecodeParams(t *testing.T) {
+    raw := map[string]string{
+        "charset": "utf-8",
+        "name": "=?UTF-8?Q?caf=C3=A9?=",
+        "filename*0*": "utf-8''%E2%82%AC",
+        "filename*1": ".pdf",
+        "filename": "fallback.pdf",
+    }
+    want := map[string]string{
+        "charset": "utf-8",
+        "name": "café",
+        "filename": "€.pdf",
+    }
+    if got := decodeParams(raw); !reflect.DeepEqual(got, want) {
+        t.Errorf("got %q, want %q", got, want)
+    }
+}
@@ -0,0 +1,109 @@
+package models
+
+// images embedded in HTML mail. The HTML refers to them as cid:<Content-ID>
+// (RFC 2392), which means nothing to a browser, so we point those
+// references at the part route instead.
+
+import (
+    "bytes"
+    "fmt"
+    "net/url"
+    "strings"
+
+    "golang.org/x/net/html"
+    "golang.org/x/net/html/atom"
+)
+
+// the Content-ID of this part, without the angle brackets
+func (node *MessageNode) ContentID() string {
+    id := strings.TrimSpace(node.Header.Get("Content-Id"))
+    return strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+}
+
+// the part of this tree with an IMAP section number, or nil
+func (node *MessageNode) Find(section string) *MessageNode {
+    var found *MessageNode
+    node.ForEach(func(part *MessageNode) {
+        if found == nil && part.Section == section {
+            found = part
+        }
+    })
+    return found
+}
+
+// point cid: references in the Sanitized HTML of this tree at the parts
+// they name, using partURL to make their URLs. Referenced parts are marked
+// Inline. Only parts with a Section can be linked to, so trees parsed from
+// a whole message body are left alone.
+func (node *MessageNode) ResolveInline(partURL func(*MessageNode) string) {
+    parts := make(map[string]*MessageNode)
+    node.ForEach(func(part *MessageNode) {
+        if id := part.ContentID(); id != "" && part.Section != "" && part.Children == nil {
+            parts[id] = part
+        }
+    })
+    if len(parts) == 0 { return }
+
+    node.ForEach(func(part *MessageNode) {
+        if part.Sanitized == "" { return }
+        part.Sanitized = rewriteCIDs(part.Sanitized, func(id string) string {
+            target, ok := parts[id]
+            if !ok { return "" }
+            target.Inline = true
+            return partURL(target)
+        })
+    })
+}
+
+// replace cid: image sources in sanitized HTML with the URLs lookup gives
+// for their Content-IDs. Sources lookup doesn't know are dropped.
+func rewriteCIDs(sanitized string, lookup func(id string) string) string {
+    var out bytes.Buffer
+    z := html.NewTokenizer(strings.NewReader(sanitized))
+    for {
+        tt := z.Next()
+        if tt == html.ErrorToken {
+            return out.String()
+        }
+        if (tt != html.StartTagToken && tt != html.SelfClosingTagToken) ||
+            !bytes.Contains(z.Raw(), []byte("cid:")) {
+            out.Write(z.Raw())
+            continue
+        }
+
+        token := z.Token()
+        if token.DataAtom != atom.Img {
+            out.WriteString(token.String())
+            continue
+        }
+        attrs := make([]html.Attribute, 0, len(token.Attr))
+        for _, attr := range token.Attr {
+            if attr.Key == "src" && strings.HasPrefix(strings.ToLower(attr.Val), "cid:") {
+                attr.Val = lookup(unescapeCID(attr.Val[len("cid:"):]))
+                if attr.Val == "" { continue }
+            }
+            attrs = append(attrs, attr)
+        }
+        token.Attr = attrs
+        out.WriteString(token.String())
+    }
+}
+
+// cid: URLs are %-escaped Content-IDs
+func unescapeCID(s string) string {
+    // a literal + is a +, not a space
+    id, err := url.QueryUnescape(strings.Replace(s, "+", "%2B", -1))
+    if err != nil { return s }
+    return id
+}
+
+// where the part route serves a part of this message
+func (m *Email) PartURL(section string) string {
+    return fmt.Sprintf("/mail/%s/%d/parts/%s", pathSegment(m.mailbox.Name), m.UID, section)
+}
+
+// escape a mailbox name so it's a single URL path segment, hierarchy
+// delimiter and all
+func pathSegment(s string) string {
+    return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
@@ -5,6 +5,8 @@ import (
     "net/mail"
     "bytes"
     "fmt"
+    "sort"
+    "strings"
 )
 
 // mailbox + message, ties back to server\
@@ -12,41 +14,165 @@ import (
 // so we'll do that
 type Mailbox struct {
     server        *Server
+    // highest UID we have seen
     latestMessage uint32
 
+    // bumped every time Update runs. Emails remember the generation they
+    // were added or changed in, so we can answer "what changed since X"
+    generation    uint64
+    // UID -> generation it was expunged in. Bounded by maxRemoved
+    removed       map[uint32]uint64
+    // generation of the last cache reset. Tokens older than this are useless
+    resetAt       uint64
+
     Name string
     Mail map[uint32]*Email
+
+    // UIDs are only meaningful together with the UIDVALIDITY they were
+    // issued under. If the server changes it, everything we cached is junk.
+    UIDValidity uint32
+    // the UID the server will give the next message to arrive
+    UIDNext     uint32
+    // CONDSTORE mod-sequence we are synced up to. 0 if unknown or
+    // unsupported
+    HighestModSeq uint64
+    // HIGHESTMODSEQ reported by the last SELECT, adopted once we've synced
+    modSeq      uint64
 }
 
 // create a new Mailbox model
 func NewMailbox(name string, server *Server) *Mailbox {
     return &Mailbox{
         server: server,
-        latestMessage: 1,
+        latestMessage: 0,
+        removed: make(map[uint32]uint64),
         Name: name,
         Mail: make(map[uint32]*Email),
     }
 }
 
-// gets all the messages on the server since the last message in the list
-func (m *Mailbox) Update() (newMail []*Email, err error) {
+// the server this mailbox lives on
+func (m *Mailbox) Server() *Server {
+    return m.server
+}
+
+// select this mailbox on the server connection, and check that our cached
+// UIDs are still valid.
+func (m *Mailbox) open(readonly bool) (*imap.Client, error) {
     c, err := m.server.Connect()
     if err != nil { return nil, err }
 
     // sync imap command to select the mailbox for actions
-    c.Select(m.Name, true)
+    cmd, err := c.Select(m.Name, readonly)
+    if err != nil {
+        return nil, fmt.Errorf("could not select mailbox %s: %v", m.Name, err)
+    }
 
-    lastHad := m.latestMessage
+    // NO response leaves the client without a mailbox
+    if c.Mailbox == nil {
+        return nil, fmt.Errorf("server refused to select mailbox %s", m.Name)
+    }
 
-    // retrieve items
-    wanted := fmt.Sprintf("%d:*", lastHad)
-    set, err := imap.NewSeqSet(wanted)
-    if err != nil { return nil, err }
-    cmd, err := c.UIDFetch(set, "RFC822.HEADER UID")
+    if m.UIDValidity != 0 && m.UIDValidity != c.Mailbox.UIDValidity {
+        m.server.logf("UIDVALIDITY of %s changed from %d to %d, dropping cache",
+            m.Name, m.UIDValidity, c.Mailbox.UIDValidity)
+        m.reset()
+    }
+    m.UIDValidity = c.Mailbox.UIDValidity
+    m.UIDNext = c.Mailbox.UIDNext
+    m.modSeq = highestModSeq(cmd)
+
+    return c, nil
+}
+
+// forget every message we know about. The next Update starts from scratch.
+func (m *Mailbox) reset() {
+    m.Mail = make(map[uint32]*Email)
+    m.removed = make(map[uint32]uint64)
+    m.latestMessage = 0
+    m.HighestModSeq = 0
+    m.generation++
+    m.resetAt = m.generation
+}
+
+// syncs our cache with the server and returns what changed: messages that
+// arrived since the last Update, messages that were expunged, and messages
+// whose flags changed.
+func (m *Mailbox) Update() (*MailboxDelta, error) {
+    // taken before open, so a UIDVALIDITY reset shows up in the delta
+    since := m.generation
+
+    c, err := m.open(true)
     if err != nil { return nil, err }
 
+    m.generation++
+
+    // never synced before: don't pull the whole mailbox down, just start
+    // watching for new mail from here on. Page loads the older messages.
+    if m.latestMessage == 0 && m.UIDNext > 1 {
+        m.latestMessage = m.UIDNext - 1
+    }
+
+    // check on the messages we already have before adding more
+    if len(m.Mail) > 0 {
+        if m.canResync() {
+            err = m.resync(c)
+        } else {
+            err = m.syncRemoved(c)
+            if err == nil {
+                err = m.syncFlags(c)
+            }
+        }
+        if err != nil { return nil, err }
+    }
+
+    if err := m.fetchNew(c); err != nil { return nil, err }
+
+    // we're now caught up to whatever the server said on SELECT
+    m.HighestModSeq = m.modSeq
+
+    return m.changesSince(since), nil
+}
+
+// References isn't in the ENVELOPE, but we need it for threading
+const referencesItem = "BODY[HEADER.FIELDS (REFERENCES)]"
+
+// the FETCH items we need to build an Email for the message list
+var listItems = []string{
+    "UID", "FLAGS", "ENVELOPE", "INTERNALDATE", "RFC822.SIZE", "BODYSTRUCTURE",
+    "BODY.PEEK[HEADER.FIELDS (REFERENCES)]",
+}
+
+// fetch all messages with UIDs higher than any we have seen
+func (m *Mailbox) fetchNew(c *imap.Client) error {
+    // "n:*" always matches the last message, even if its UID is lower
+    // than n. fetchHeaders knows to skip messages we already have.
+    wanted := fmt.Sprintf("%d:*", m.latestMessage + 1)
+    set, err := imap.NewSeqSet(wanted)
+    if err != nil { return err }
+
+    _, err = m.fetchHeaders(c, set)
+    return err
+}
+
+// fetch headers for a set of UIDs and put the messages in the cache.
+// Messages we already have are returned from the cache with their flags
+// refreshed.
+func (m *Mailbox) fetchHeaders(c *imap.Client, set *imap.SeqSet) ([]*Email, error) {
     // result
-    newMail = make([]*Email, 0, 5)
+    emails := make([]*Email, 0, 5)
+
+    // try the disk cache before the network
+    loaded, set := m.loadCached(set)
+    if len(loaded) > 0 {
+        fresh, err := m.refreshCached(c, loaded)
+        if err != nil { return nil, err }
+        emails = append(emails, fresh...)
+        if set.Empty() { return emails, nil }
+    }
+
+    cmd, err := c.UIDFetch(set, listItems...)
+    if err != nil { return nil, err }
 
     for cmd.InProgress() {
         // Wait for the next response (no timeout)
@@ -57,38 +183,21 @@ func (m *Mailbox) Update() (newMail []*Email, err error) {
         // retrieve message UID
         // construct local Message structure from given header
         // store message in map
-        // append UID to newMessages list
         for _, rsp := range cmd.Data {
             info := rsp.MessageInfo()
-            if info.Attrs["UID"] != nil {
-                // construct message
-                header := imap.AsBytes(info.Attrs["RFC822.HEADER"])
-                // TODO: catch this error
-                if msg, _ := mail.ReadMessage(bytes.NewReader(header)); msg != nil {
-                    // we could read the message and retrieve the UID
-                    // so this is valid to push into our storage system
-                    m.latestMessage = info.UID
-
-                    my_msg := &MessageNode{
-                        Header: msg.Header,
-                        ContentType: msg.Header.Get(ContentType),
-                    }
-
-                    email := &Email {
-                        server: m.server,
-                        mailbox: m,
-                        UID: info.UID,
-                        Message: my_msg,
-                    }
-
-                    // store
-                    newMail = append(newMail, email)
-                    m.Mail[info.UID] = email
-                } else {
-                    fmt.Printf("mail.ReadMessage failed on UID %d\n", info.UID)
-                }
-            } else {
-                fmt.Printf("Message %v had no UID. Skipped.\n", info)
+            if info.Attrs["UID"] == nil {
+                m.server.logf("Message %v had no UID. Skipped.", info)
+                continue
+            }
+
+            if email, ok := m.Mail[info.UID]; ok {
+                email.updateFlags(info.Flags)
+                emails = append(emails, email)
+                continue
+            }
+
+            if email := m.newEmail(info); email != nil {
+                emails = append(emails, email)
             }
         }
 
@@ -96,7 +205,143 @@ func (m *Mailbox) Update() (newMail []*Email, err error) {
         cmd.Data = nil
     }
 
-    return newMail, nil
+    _, err = cmd.Result(imap.OK)
+    return emails, err
+}
+
+// fetch up-to-date flags for messages loaded from the disk cache. Any the
+// server no longer has are dropped.
+func (m *Mailbox) refreshCached(c *imap.Client, loaded []*Email) ([]*Email, error) {
+    set := &imap.SeqSet{}
+    for _, email := range loaded {
+        set.AddNum(email.UID)
+    }
+    cmd, err := imap.Wait(c.UIDFetch(set, "UID", "FLAGS"))
+    if err != nil { return nil, err }
+
+    exists := make(map[uint32]bool)
+    for _, rsp := range cmd.Data {
+        info := rsp.MessageInfo()
+        if email, ok := m.Mail[info.UID]; ok && info.Attrs["FLAGS"] != nil {
+            email.updateFlags(info.Flags)
+            exists[info.UID] = true
+        }
+    }
+
+    fresh := make([]*Email, 0, len(loaded))
+    for _, email := range loaded {
+        if exists[email.UID] {
+            fresh = append(fresh, email)
+        } else {
+            email.closeMessage()
+            delete(m.Mail, email.UID)
+        }
+    }
+    return fresh, nil
+}
+
+// build an Email from a FETCH of listItems and store it in the cache
+func (m *Mailbox) newEmail(info *imap.MessageInfo) *Email {
+    if info.Attrs["ENVELOPE"] == nil {
+        m.server.logf("FETCH for UID %d had no ENVELOPE", info.UID)
+        return nil
+    }
+
+    if info.UID > m.latestMessage {
+        m.latestMessage = info.UID
+    }
+
+    structure := parseBodyStructure(info.Attrs["BODYSTRUCTURE"])
+    email := &Email {
+        server: m.server,
+        mailbox: m,
+        UID: info.UID,
+        Summary: parseSummary(info, structure),
+        structure: structure,
+        Flags: flagList(info.Flags),
+        added: m.generation,
+        changed: m.generation,
+    }
+
+    // store
+    m.Mail[info.UID] = email
+    m.cacheEmail(email)
+    return email
+}
+
+// the UIDs of every message we have cached, as a set
+func (m *Mailbox) cachedSet() (*imap.SeqSet, error) {
+    uids := make([]uint32, 0, len(m.Mail))
+    for uid := range m.Mail {
+        uids = append(uids, uid)
+    }
+    return uidSet(uids)
+}
+
+// ask the server which of our cached UIDs still exist, and drop the ones
+// that don't
+func (m *Mailbox) syncRemoved(c *imap.Client) error {
+    set, err := m.cachedSet()
+    if err != nil { return err }
+    cmd, err := imap.Wait(c.UIDSearch("UID", set))
+    if err != nil { return err }
+
+    exists := make(map[uint32]bool)
+    for _, rsp := range cmd.Data {
+        for _, uid := range rsp.SearchResults() {
+            exists[uid] = true
+        }
+    }
+
+    for uid := range m.Mail {
+        if !exists[uid] {
+            m.forget(uid)
+        }
+    }
+    return nil
+}
+
+// refresh the flags on every message we have cached
+func (m *Mailbox) syncFlags(c *imap.Client) error {
+    set, err := m.cachedSet()
+    if err != nil { return err }
+    cmd, err := imap.Wait(c.UIDFetch(set, "UID FLAGS"))
+    if err != nil { return err }
+
+    for _, rsp := range cmd.Data {
+        info := rsp.MessageInfo()
+        if email, ok := m.Mail[info.UID]; ok {
+            email.updateFlags(info.Flags)
+        }
+    }
+    return nil
+}
+
+// remove a message from the cache, remembering that it went away
+func (m *Mailbox) forget(uid uint32) {
+    if email, ok := m.Mail[uid]; ok {
+        email.closeMessage()
+        delete(m.Mail, uid)
+        m.removed[uid] = m.generation
+        if len(m.removed) > maxRemoved {
+            m.pruneRemoved()
+        }
+    }
+}
+
+// every message we have cached, oldest UID first
+func (m *Mailbox) Messages() []*Email {
+    uids := make([]uint32, 0, len(m.Mail))
+    for uid := range m.Mail {
+        uids = append(uids, uid)
+    }
+    sort.Sort(uidSlice(uids))
+
+    emails := make([]*Email, len(uids))
+    for i, uid := range uids {
+        emails[i] = m.Mail[uid]
+    }
+    return emails
 }
 
 
@@ -106,30 +351,177 @@ type Email struct {
     UID       uint32
     server    *Server
     mailbox   *Mailbox
-    Message   *MessageNode
+    // what the message list shows
+    Summary   *Summary
+    // the parsed message. Only filled in once the body has been fetched
+    Message   *MessageNode `json:",omitempty"`
+    // MIME layout from BODYSTRUCTURE
+    structure *BodyStructure
     bodyData  []byte
+
+    // system flags like \Seen and any custom keywords, sorted
+    Flags     []string
+
+    // generations of the mailbox this email was added and last changed in
+    added     uint64
+    changed   uint64
+}
+
+// store new flags from the server, noting if they changed
+func (m *Email) updateFlags(flags imap.FlagSet) {
+    list := flagList(flags)
+    if flagsEqual(m.Flags, list) { return }
+    m.Flags = list
+    m.changed = m.mailbox.generation
+    // not written to the disk cache: flags change far more often than
+    // summaries, and refreshCached fetches them again on load anyway
+}
+
+// does this message have the given flag or keyword set?
+// flag names are case-insensitive in IMAP
+func (m *Email) HasFlag(flag string) bool {
+    for _, f := range m.Flags {
+        if strings.EqualFold(f, flag) { return true }
+    }
+    return false
+}
+
+// has the message been read?
+func (m *Email) Seen() bool {
+    return m.HasFlag(FlagSeen)
+}
+
+// the user-defined flags on this message, like $Label1 or $Junk
+func (m *Email) Keywords() []string {
+    keywords := make([]string, 0)
+    for _, f := range m.Flags {
+        if !strings.HasPrefix(f, "\\") {
+            keywords = append(keywords, f)
+        }
+    }
+    return keywords
+}
+
+// replace all of the message's flags
+func (m *Email) SetFlags(flags ...string) error {
+    return m.mailbox.SetFlags([]uint32{m.UID}, flags...)
+}
+
+// add flags to the message, leaving the others alone
+func (m *Email) AddFlags(flags ...string) error {
+    return m.mailbox.AddFlags([]uint32{m.UID}, flags...)
+}
+
+// remove flags from the message, leaving the others alone
+func (m *Email) RemoveFlags(flags ...string) error {
+    return m.mailbox.RemoveFlags([]uint32{m.UID}, flags...)
 }
 
 // Issue a FETCH request for this message
 // TODO make private, this is an abstraction-breaker
-func (m *Email) RetrieveRaw(requestType string) (cmd *imap.Command, err error) {
-    c, err := m.server.Connect()
+func (m *Email) RetrieveRaw(items ...string) (cmd *imap.Command, err error) {
+    // make sure it's our mailbox that's selected. Read-write, so fetching
+    // BODY[] can set \Seen
+    c, err := m.mailbox.open(false)
     if err != nil { return }
 
     // fetch message by UID
     set, err := imap.NewSeqSet(fmt.Sprintf("%d", m.UID))
     if err != nil { return }
-    cmd, err = c.UIDFetch(set, requestType)
+    cmd, err = c.UIDFetch(set, items...)
     return cmd, err
 }
 
 
+// the whole raw message, as stored on the server. Doesn't mark it \Seen.
+func (m *Mailbox) Raw(uid uint32) ([]byte, error) {
+    if email, ok := m.Mail[uid]; ok {
+        return email.Raw()
+    }
+    email := &Email{server: m.server, mailbox: m, UID: uid}
+    return email.Raw()
+}
+
+// the whole raw message, as stored on the server. Doesn't mark it \Seen.
+func (m *Email) Raw() ([]byte, error) {
+    if raw, ok := m.cachedPart("BODY[]"); ok {
+        return raw, nil
+    }
+
+    cmd, err := imap.Wait(m.RetrieveRaw("BODY.PEEK[]"))
+    if err != nil { return nil, err }
+    if len(cmd.Data) == 0 {
+        return nil, fmt.Errorf("message %d not found", m.UID)
+    }
+
+    raw := imap.AsBytes(cmd.Data[0].MessageInfo().Attrs["BODY[]"])
+    m.cachePart("BODY[]", raw)
+    return raw, nil
+}
+
+// the whole raw messages with the given UIDs, without marking them \Seen.
+// Unlike calling Raw for each, the mailbox is selected once and they all
+// come in a single UID FETCH. Each is handed to fn as it arrives, so they
+// aren't all held at once, and none go through the disk cache. UIDs the
+// server doesn't have are skipped. After fn fails, the rest of the FETCH
+// is read and thrown away, and fn's error is returned.
+func (m *Mailbox) RawMessages(uids []uint32, fn func(uid uint32, raw []byte) error) error {
+    if len(uids) == 0 { return nil }
+    set, err := uidSet(uids)
+    if err != nil { return err }
+
+    c, err := m.open(true)
+    if err != nil { return err }
+    cmd, err := c.UIDFetch(set, "UID", "BODY.PEEK[]")
+    if err != nil { return err }
+
+    var fnErr error
+    for cmd.InProgress() {
+        if err := c.Recv(-1); err != nil { return err }
+        for _, rsp := range cmd.Data {
+            info := rsp.MessageInfo()
+            raw := info.Attrs["BODY[]"]
+            if fnErr != nil || info.UID == 0 || raw == nil { continue }
+            fnErr = fn(info.UID, imap.AsBytes(raw))
+        }
+        cmd.Data = nil
+    }
+
+    if _, err := cmd.Result(imap.OK); err != nil { return err }
+    return fnErr
+}
+
+// the flags of every message in the mailbox, by UID. Doesn't touch the
+// cache, so it's cheap enough for syncing big mailboxes.
+func (m *Mailbox) UIDFlags() (map[uint32][]string, error) {
+    c, err := m.open(true)
+    if err != nil { return nil, err }
+
+    flags := make(map[uint32][]string)
+    if c.Mailbox.Messages == 0 { return flags, nil }
+
+    set, _ := imap.NewSeqSet("1:*")
+    cmd, err := imap.Wait(c.UIDFetch(set, "UID", "FLAGS"))
+    if err != nil { return nil, err }
+    for _, rsp := range cmd.Data {
+        info := rsp.MessageInfo()
+        if info.UID == 0 { continue }
+        flags[info.UID] = flagList(info.Flags)
+    }
+    return flags, nil
+}
+
 // messages are usually created with just header information
 // this method downloads the actual body of the message from the server,
 // optionally marking the message as '\Seen', in IMAP terms.
 func (m *Email) Body(setRead bool) (body []byte, err error) {
-    // cache
-    if m.bodyData != nil {
+    // cache. Fetching BODY[TEXT] would have set \Seen, so set it ourselves
+    if m.bodyData != nil || m.loadCachedBody() {
+        if setRead && !m.Seen() {
+            if err := m.mailbox.AddFlags([]uint32{m.UID}, FlagSeen); err != nil {
+                m.server.logf("could not mark UID %d \\Seen: %v", m.UID, err)
+            }
+        }
         return m.bodyData, nil
     }
 
@@ -140,20 +532,81 @@ func (m *Email) Body(setRead bool) (body []byte, err error) {
     } else {
         requestType = "BODY.PEEK[TEXT]"
     }
+    items := []string{requestType}
+    // the message list doesn't keep the full header, and we need it to
+    // make sense of the body
+    if m.Message == nil {
+        items = append(items, "BODY.PEEK[HEADER]")
+    }
 
-    cmd, err := m.RetrieveRaw(requestType)
+    cmd, err := m.RetrieveRaw(items...)
     cmd, err = imap.Wait(cmd, err)
     if err != nil { return }
+    if len(cmd.Data) == 0 {
+        return nil, fmt.Errorf("message %d not found", m.UID)
+    }
 
     info := cmd.Data[0].MessageInfo()
+    if m.Message == nil {
+        header := imap.AsBytes(info.Attrs["BODY[HEADER]"])
+        if err := m.setHeader(header); err != nil { return nil, err }
+        m.cachePart("BODY[HEADER]", header)
+    }
     m.bodyData = imap.AsBytes(info.Attrs["BODY[TEXT]"])
+    m.cachePart("BODY[TEXT]", m.bodyData)
     return m.bodyData, nil
 }
 
+// fill in Message from the raw header
+func (m *Email) setHeader(header []byte) error {
+    msg, err := mail.ReadMessage(bytes.NewReader(header))
+    if err != nil { return err }
+    m.setMessage(&MessageNode{
+        Header: msg.Header,
+        ContentType: msg.Header.Get(ContentType),
+    })
+    return nil
+}
+
+// replace Message, deleting the temporary files behind the old tree
+func (m *Email) setMessage(node *MessageNode) {
+    if m.Message != node {
+        m.closeMessage()
+    }
+    m.Message = node
+}
+
+// delete the temporary files behind Message, when it's being replaced or
+// the Email is leaving the cache. The header and structure stay usable.
+func (m *Email) closeMessage() {
+    if m.Message == nil { return }
+    if err := m.Message.Close(); err != nil {
+        m.server.logf("could not delete the spooled parts of message %d: %v", m.UID, err)
+    }
+}
+
+// try to load the body (and header, if we need it) from the disk cache
+func (m *Email) loadCachedBody() bool {
+    body, ok := m.cachedPart("BODY[TEXT]")
+    if !ok { return false }
+
+    if m.Message == nil {
+        header, ok := m.cachedPart("BODY[HEADER]")
+        if !ok || m.setHeader(header) != nil { return false }
+    }
+
+    m.bodyData = body
+    return true
+}
+
 // parse the raw RFC822.BODY bytes into seperate attatchment pieces
 // if the body is not a multi-part body, this will still return a
 // lenght-one slice of parts.
 // this is how you get parts.
+// The tree replaces Message, so it's closed along with the Email. The whole
+// body has already been fetched into memory by Body, so the parse limits
+// only bound what parsing adds on top of it: big parts are spooled rather
+// than decoded into a second copy.
 func (m *Email) ParseBody() (*MessageNode, error) {
     // can't parse the body unless we have it
     if m.bodyData == nil {
@@ -167,13 +620,15 @@ func (m *Email) ParseBody() (*MessageNode, error) {
 
     node, err := MessageToNode(msg)
     if err != nil {
-        if _, ok := err.(ChildError); ok {
+        switch err.(type) {
+        case ChildError, *LimitError:
             // mostly-good node, keep it
-            m.Message = node
+            m.setMessage(node)
             return node, err
         }
         return nil, err
     }
 
+    m.setMessage(node)
     return node, nil
 }
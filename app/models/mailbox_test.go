@@ -0,0 +1,55 @@
+package models
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestCachedBodyMarksSeen(t *testing.T) {
+    tests := []struct {
+        name    string
+        flags   []string
+        setRead bool
+        store   bool
+    }{
+        {"unread, reading", []string{}, true, true},
+        {"unread, peeking", []string{}, false, false},
+        {"already read", []string{FlagSeen}, true, false},
+    }
+
+    for _, test := range tests {
+        m, f := newFakeMailbox(t, "", 1, func(command string) string {
+            if strings.HasPrefix(command, "UID STORE") {
+                return "* 1 FETCH (UID 7 FLAGS (\\Seen))\r\n"
+            }
+            return ""
+        })
+        email := &Email{server: m.server, mailbox: m, UID: 7, Flags: test.flags, bodyData: []byte("hello")}
+        m.Mail[7] = email
+
+        body, err := email.Body(test.setRead)
+        f.Close()
+        if err != nil || string(body) != "hello" {
+            t.Errorf("%s: body %q, %v", test.name, body, err)
+        }
+
+        stores := make([]string, 0)
+        for _, command := range f.Commands() {
+            if strings.HasPrefix(command, "UID STORE") {
+                stores = append(stores, command)
+            }
+        }
+        if !test.store {
+            if len(stores) != 0 {
+                t.Errorf("%s: sent %q", test.name, stores)
+            }
+            continue
+        }
+        if len(stores) != 1 || stores[0] != `UID STORE 7 +FLAGS (\Seen)` {
+            t.Errorf("%s: sent %q", test.name, stores)
+        }
+        if !email.Seen() {
+            t.Errorf("%s: flags are %v", test.name, email.Flags)
+        }
+    }
+}
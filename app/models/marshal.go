@@ -5,7 +5,6 @@ import (
     "io/ioutil"
     "encoding/json"
     "bytes"
-    "fmt"
 )
 
 // A wrapper around io.Reader that allows marshalling the data in the io.Reader
@@ -59,22 +58,3 @@ func NewMarshalReader(r io.Reader) *MarshalReader {
         reader: r,
     }
 }
-
-
-
-
-// subtly duplicate a reader if you're worried
-// use the `use_instead` reader for your dangerous operation
-// if things go wrong, you have the `backup` to return to.
-func backupReader(in_danger io.Reader) (*MarshalReader, *MarshalReader) {
-    data, err := ioutil.ReadAll(in_danger)
-    if err != nil {
-        fmt.Printf("Error in backupReader creation: %v\n", err)
-    }
-    use_instead := NewMarshalReader(bytes.NewReader(data))
-    backup := NewMarshalReader(bytes.NewReader(data))
-
-    return use_instead, backup
-}
-
-var BackupReader = backupReader
@@ -0,0 +1,162 @@
+package models
+
+// moving and copying messages between mailboxes on the same server.
+// UID MOVE (RFC 6851) does it in one step; otherwise we COPY, mark the
+// originals \Deleted and expunge them (see expunge).
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "fmt"
+)
+
+// copy messages into another mailbox. Returns the UIDs the copies were
+// given in dest, keyed by their UID here, if the server told us (COPYUID).
+func (m *Mailbox) CopyTo(uids []uint32, dest *Mailbox) (map[uint32]uint32, error) {
+    set, err := m.transferSet(uids, dest)
+    if err != nil { return nil, err }
+
+    c, err := m.open(true)
+    if err != nil { return nil, err }
+
+    cmd, err := imap.Wait(c.UIDCopy(set, dest.Name))
+    if err != nil { return nil, err }
+
+    validity, copied := m.copyUIDs(cmd.Data, cmd)
+    dest.addCopies(validity, copied, m)
+    return copied, nil
+}
+
+// move messages into another mailbox, and drop them from our cache.
+// Without MOVE, the originals might not be expungable on their own (see
+// expunge), in which case they're left behind marked \Deleted.
+func (m *Mailbox) MoveTo(uids []uint32, dest *Mailbox) (map[uint32]uint32, error) {
+    copied, _, err := m.moveTo(uids, dest)
+    return copied, err
+}
+
+// MoveTo, also saying whether the originals were left behind
+func (m *Mailbox) moveTo(uids []uint32, dest *Mailbox) (map[uint32]uint32, bool, error) {
+    set, err := m.transferSet(uids, dest)
+    if err != nil { return nil, false, err }
+
+    c, err := m.open(false)
+    if err != nil { return nil, false, err }
+    if c.Mailbox.ReadOnly {
+        return nil, false, fmt.Errorf("mailbox %s is read-only", m.Name)
+    }
+
+    var copied map[uint32]uint32
+    left := false
+    if c.Caps["MOVE"] {
+        cmd, err := imap.Wait(c.Send("UID MOVE", set, c.Quote(imap.UTF7Encode(dest.Name))))
+        if err != nil { return nil, false, err }
+        validity, moved := m.copyUIDs(cmd.Data, cmd)
+        dest.addCopies(validity, moved, m)
+        copied = moved
+    } else {
+        cmd, err := imap.Wait(c.UIDCopy(set, dest.Name))
+        if err != nil { return nil, false, err }
+        validity, moved := m.copyUIDs(cmd.Data, cmd)
+        // before the originals pick up \Deleted
+        dest.addCopies(validity, moved, m)
+        copied = moved
+
+        if err := m.AddFlags(uids, FlagDeleted); err != nil { return nil, false, err }
+        expunged, err := m.expunge(c, uids, set)
+        if err != nil { return nil, false, err }
+        if !expunged {
+            m.server.logf("leaving moved messages marked \\Deleted in %s", m.Name)
+            left = true
+        }
+    }
+
+    m.generation++
+    for _, uid := range uids {
+        m.forget(uid)
+    }
+    return copied, left, nil
+}
+
+// copy this message into another mailbox. Returns its UID there, or 0 if
+// the server didn't say.
+func (m *Email) CopyTo(dest *Mailbox) (uint32, error) {
+    copied, err := m.mailbox.CopyTo([]uint32{m.UID}, dest)
+    return copied[m.UID], err
+}
+
+// move this message into another mailbox. Returns its new UID, or 0 if
+// the server didn't say.
+func (m *Email) MoveTo(dest *Mailbox) (uint32, error) {
+    moved, err := m.mailbox.MoveTo([]uint32{m.UID}, dest)
+    return moved[m.UID], err
+}
+
+// check a move or copy makes sense, and build its UID set
+func (m *Mailbox) transferSet(uids []uint32, dest *Mailbox) (*imap.SeqSet, error) {
+    if dest.server != m.server {
+        return nil, fmt.Errorf("can't move messages between servers")
+    }
+    if dest.Name == m.Name {
+        return nil, fmt.Errorf("messages are already in %s", m.Name)
+    }
+    return uidSet(uids)
+}
+
+// pull the source -> destination UID mapping out of a COPYUID response
+// code. UID MOVE sends it untagged before the expunges; COPY puts it on the
+// tagged OK. Also returns the destination UIDVALIDITY the new UIDs belong to.
+func (m *Mailbox) copyUIDs(data []*imap.Response, cmd *imap.Command) (uint32, map[uint32]uint32) {
+    var validity uint32
+    copied := make(map[uint32]uint32)
+
+    responses := append([]*imap.Response(nil), data...)
+    if rsp, err := cmd.Result(imap.OK); err == nil {
+        responses = append(responses, rsp)
+    }
+
+    for _, rsp := range responses {
+        // COPYUID uidvalidity source-uids dest-uids
+        if rsp.Label != "COPYUID" || len(rsp.Fields) < 4 { continue }
+        from, err := expandSet(fmt.Sprint(rsp.Fields[2]))
+        if err != nil { continue }
+        to, err := expandSet(fmt.Sprint(rsp.Fields[3]))
+        if err != nil || len(from) != len(to) {
+            m.server.logf("bad COPYUID response %v", rsp)
+            continue
+        }
+        validity = imap.AsNumber(rsp.Fields[1])
+        for i := range from {
+            copied[from[i]] = to[i]
+        }
+    }
+
+    return validity, copied
+}
+
+// put copies of cached messages from another mailbox into our cache, under
+// their new UIDs. We only trust the UIDs if they were handed out under the
+// UIDVALIDITY we last synced with.
+func (m *Mailbox) addCopies(validity uint32, copied map[uint32]uint32, from *Mailbox) {
+    if len(copied) == 0 || m.UIDValidity == 0 || m.UIDValidity != validity { return }
+
+    m.generation++
+    for old, uid := range copied {
+        orig, ok := from.Mail[old]
+        if !ok { continue }
+        if _, ok := m.Mail[uid]; ok { continue }
+
+        email := *orig
+        email.UID = uid
+        email.mailbox = m
+        email.Flags = append([]string(nil), orig.Flags...)
+        // don't share a parsed tree, whose spooled parts either copy
+        // could delete
+        if orig.Message != nil {
+            email.Message = &MessageNode{Header: orig.Message.Header, ContentType: orig.Message.ContentType}
+        }
+        email.added = m.generation
+        email.changed = m.generation
+        m.Mail[uid] = &email
+        m.cacheEmail(&email)
+    }
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestMoveWithoutMOVE(t *testing.T) {
+    tests := []struct {
+        name     string
+        caps     string
+        // what UID SEARCH DELETED finds once ours are marked
+        deleted  string
+        commands []string
+    }{
+        {"UIDPLUS", "UIDPLUS", "",
+            []string{`UID COPY 3:4 "Trash"`, `UID STORE 3:4 +FLAGS (\Deleted)`, "UID EXPUNGE 3:4"}},
+        {"only ours are deleted", "", "3 4",
+            []string{`UID COPY 3:4 "Trash"`, `UID STORE 3:4 +FLAGS (\Deleted)`, "UID SEARCH CHARSET UTF-8 DELETED", "EXPUNGE"}},
+        {"others are deleted too", "", "3 4 9",
+            []string{`UID COPY 3:4 "Trash"`, `UID STORE 3:4 +FLAGS (\Deleted)`, "UID SEARCH CHARSET UTF-8 DELETED"}},
+    }
+
+    for _, test := range tests {
+        m, f := newFakeMailbox(t, test.caps, 9, func(command string) string {
+            if command == "UID SEARCH CHARSET UTF-8 DELETED" {
+                return "* SEARCH " + test.deleted + "\r\n"
+            }
+            return ""
+        })
+        for _, uid := range []uint32{3, 4, 5} {
+            m.Mail[uid] = &Email{server: m.server, mailbox: m, UID: uid, Flags: []string{}}
+        }
+        // as if we'd synced before
+        m.UIDValidity, m.generation = 1, 1
+        token := m.Token()
+
+        _, err := m.MoveTo([]uint32{3, 4}, NewMailbox("Trash", m.server))
+        f.Close()
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+
+        sent := make([]string, 0)
+        for _, command := range f.Commands() {
+            if !strings.HasPrefix(command, "SELECT ") && !strings.HasPrefix(command, "EXAMINE ") {
+                sent = append(sent, command)
+            }
+        }
+        if strings.Join(sent, "\n") != strings.Join(test.commands, "\n") {
+            t.Errorf("%s: sent %q, want %q", test.name, sent, test.commands)
+        }
+
+        // gone from the list either way, and token holders hear about it
+        if _, ok := m.Mail[3]; ok || len(m.Mail) != 1 {
+            t.Errorf("%s: %d messages still cached", test.name, len(m.Mail))
+        }
+        if removed := m.Changes(token).Removed; len(removed) != 2 {
+            t.Errorf("%s: delta removed %v", test.name, removed)
+        }
+    }
+}
@@ -4,10 +4,10 @@ package models
 // this file wants to recursivley parse RFC 2046 messages
 
 import (
+    "bytes"
     "fmt"
     "regexp"
     "mime"
-    "mime/multipart"
     "net/mail"
     "io"
     "strings"
@@ -29,6 +29,12 @@ const TypeMultipart  = "multipart"
 // Regexp that matches MIME multipart MIME types
 var   MultipartRegex = regexp.MustCompile("^"+TypeMultipart)
 
+// is this the MIME type of a whole message attached to another?
+// (RFC 2046 section 5.2.1, and RFC 6532 for message/global)
+func IsMessageType(content_type string) bool {
+    return content_type == "message/rfc822" || content_type == "message/global"
+}
+
 // is a raw content-type string a multipart message?
 func MultipartType(content_type string) (boundry string, ok bool) {
     mt, params, err := mime.ParseMediaType(content_type)
@@ -80,6 +86,73 @@ type MessageNode struct {
     // contains data only if we could not derive Children
     // its nil in the best cases <3
     Body        *MarshalReader
+
+    // IMAP part specifier ("1.2") for fetching this part by itself.
+    // only set on trees built from BODYSTRUCTURE
+    Section     string `json:",omitempty"`
+    // size of the encoded part in bytes, if known
+    Size        uint32 `json:",omitempty"`
+
+    // the Content-Transfer-Encoding Body arrived in. Body itself is
+    // decoded, unless Encoded is set
+    Encoding    string `json:",omitempty"`
+    // true if Body couldn't be decoded and is still in Encoding
+    Encoded     bool   `json:",omitempty"`
+
+    // decoded file name of an attachment
+    Filename    string `json:",omitempty"`
+
+    // for text/html parts, Body cleaned up so it's safe to show.
+    // Body itself is left as the sender wrote it
+    Sanitized   string `json:",omitempty"`
+    // true if an HTML part shows this part in place, as a cid: image
+    Inline      bool   `json:",omitempty"`
+
+    // true if the part was over a size limit, and Body is only the start
+    Truncated   bool   `json:",omitempty"`
+    // where a big Body is kept while it's parsed. See Close
+    spool       *spool
+}
+
+// replace the body of this node with some data, still in the part's
+// Content-Transfer-Encoding and charset
+func (node *MessageNode) SetBody(data []byte) {
+    node.Encoding = transferEncoding(node.Header)
+    node.Encoded = false
+
+    decoded, err := decodeTransfer(node.Encoding, data)
+    if err != nil {
+        debug("could not decode ", node.Encoding, " body: ", err)
+        // better a partly decoded body than none, unless we got nothing
+        if len(decoded) == 0 {
+            decoded = data
+            node.Encoded = true
+        }
+    }
+
+    // text goes to the browser as a JSON string, so it had better be UTF-8
+    if IsText(node) && !node.Encoded {
+        decoded = toUTF8(node.ContentTypeParams["charset"], decoded)
+    }
+
+    node.Sanitized = ""
+    if node.ContentType == TypeHTML && !node.Encoded {
+        node.Sanitized = SanitizeHTML(bytes.NewReader(decoded))
+    }
+
+    node.Body = NewMarshalReader(bytes.NewReader(decoded))
+    node.Body.MarshalAsString = IsText(node)
+}
+
+// is this part something the user would call an attachment?
+// see BodyStructure.IsAttachment
+func (node *MessageNode) IsAttachment() bool {
+    if node.Children != nil || node.Inline { return false }
+    disposition, _, _ := parseMediaType(node.Header.Get("Content-Disposition"))
+    if disposition == "attachment" { return true }
+    if disposition == "inline" { return false }
+    _, named := node.ContentTypeParams["name"]
+    return named && !StartsWithText.MatchString(node.ContentType)
 }
 
 // nice to-string for debugging
@@ -103,7 +176,7 @@ func (node *MessageNode) StringIndent(indent string) string {
             bodies[i] = child.StringIndent(indent + childIndent)
         }
         return strings.Join(append(header, bodies...), "\n")
-    } else {
+    } else if node.Body != nil {
         // 
         bodyData, err := node.Body.Data()
         if err != nil {
@@ -156,8 +229,8 @@ func IsText(node *MessageNode) bool {
     // know text types
     if _, ok := TextMimeTypes[mt]; ok { res = true }
 
-    // ContentEncoding based detection
-    // TODO
+    // RFC 2045: no (or an unreadable) Content-Type means text/plain
+    if mt == "" && node.Children == nil { res = true }
 
     debug("is IsText text? ", mt, ": ", res)
     return res
@@ -168,72 +241,9 @@ func IsText(node *MessageNode) bool {
 // good switching code to work with message nodes
 // If errors occur whilst creating the sub-tree, such errors will be 
 // returned in a ChildError mapping. You may ignore such errors for the most
+// part. Parsing is limited by DefaultParseLimits; big parts are kept in
+// temporary files until the tree is Closed.
 func MessageToNode(msg *mail.Message) (*MessageNode, error) {
-
     debug("starting message to node for message: ", msg)
-    body, backup := backupReader(msg.Body)
-
-    node := &MessageNode{
-        Header: msg.Header,
-        Body: backup,
-    }
-
-    ct, params, err := mime.ParseMediaType(msg.Header.Get(ContentType))
-
-    if err == nil {
-        node.ContentType = ct
-        node.ContentTypeParams = params
-        if boundry, ok := params[Boundary]; ok {
-            // parse the data as a multipart!
-
-            multi := multipart.NewReader(body, boundry)
-            child_err_occured := false
-            child_errs := make(ChildError)
-            node.Children = make([]*MessageNode, 0, 5)
-
-            // read new Parts off the multipart parser
-            for part, err := multi.NextPart(); err != io.EOF; part, err = multi.NextPart() {
-                // check errors
-                if err != nil {
-                    debug("error occured while making part: ", part, " error: ", err)
-                    // restore backup and abort parsing
-                    return node, fmt.Errorf("Aborted Multipart#NextPart at error: %v", err)
-                }
-
-                // create message so we can recurse
-                sub_msg := &mail.Message {
-                    Header: mail.Header(part.Header),
-                    Body:   NewMarshalReader(part),
-                }
-
-                // create child node
-                child, err := MessageToNode(sub_msg)
-
-                // store any errors
-                if err != nil {
-                    child_err_occured = true
-                    child_errs[child] = err
-                }
-
-                // store child
-                node.Children = append(node.Children, child)
-            } // end enumerate parts
-
-            // don't need this data anymore, since we have the children
-            node.Body = nil
-
-            if child_err_occured {
-                return node, child_errs
-            }
-        } // end has-boundry-parse-sections
-    } // end decoded-mime-type
-
-    if node.Body != nil {
-        // make sure body has text export type
-        // so the browser doesn't have to do MIME detection
-        node.Body.MarshalAsString = IsText(node)
-    }
-    return node, nil
+    return (&parser{DefaultParseLimits}).message(msg.Header, msg.Body)
 }
-
-
@@ -0,0 +1,529 @@
+package models
+
+// message ordering and threading. The SORT and THREAD extensions
+// (RFC 5256) do this on the server; when they aren't advertised, we do the
+// same thing here from the messages' headers, fetching any we don't have.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+)
+
+// things we can sort a mailbox by
+type SortKey string
+
+const (
+    // the Date header
+    SortDate    SortKey = "DATE"
+    // when the message arrived in the mailbox
+    SortArrival SortKey = "ARRIVAL"
+    // the mailbox part of the first From address
+    SortFrom    SortKey = "FROM"
+    // the subject, without Re: and friends
+    SortSubject SortKey = "SUBJECT"
+    // message size
+    SortSize    SortKey = "SIZE"
+)
+
+var sortKeys = map[string]SortKey{
+    "date":    SortDate,
+    "arrival": SortArrival,
+    "from":    SortFrom,
+    "subject": SortSubject,
+    "size":    SortSize,
+}
+
+// look up a sort key by its lowercase name, as used in URLs
+func ParseSortKey(name string) (SortKey, error) {
+    if key, ok := sortKeys[strings.ToLower(name)]; ok {
+        return key, nil
+    }
+    return "", fmt.Errorf("unknown sort key %q", name)
+}
+
+// get the UIDs of the messages matching criteria (nil for all), ordered by
+// key. On servers without SORT this loads the headers of every match; see
+// matching.
+func (m *Mailbox) Sort(key SortKey, reverse bool, criteria *Criteria) ([]uint32, error) {
+    if err := criteria.Err(); err != nil { return nil, err }
+    c, err := m.open(true)
+    if err != nil { return nil, err }
+
+    if !c.Caps["SORT"] {
+        return m.sortLocally(key, reverse, criteria)
+    }
+
+    program := []imap.Field{string(key)}
+    if reverse {
+        program = []imap.Field{"REVERSE", string(key)}
+    }
+    args := append([]imap.Field{program, "UTF-8"}, criteria.fields(c)...)
+    cmd, err := imap.Wait(c.Send("UID SORT", args...))
+    if err != nil { return nil, err }
+
+    uids := make([]uint32, 0)
+    for _, rsp := range cmd.Data {
+        for _, f := range rsp.Fields[1:] {
+            uids = append(uids, imap.AsNumber(f))
+        }
+    }
+    return uids, nil
+}
+
+// the same as Sort, but done here
+func (m *Mailbox) sortLocally(key SortKey, reverse bool, criteria *Criteria) ([]uint32, error) {
+    emails, err := m.matching(criteria)
+    if err != nil { return nil, err }
+
+    sort.Sort(&emailSorter{emails, key, reverse})
+    uids := make([]uint32, len(emails))
+    for i, email := range emails {
+        uids[i] = email.UID
+    }
+    return uids, nil
+}
+
+// the messages matching criteria, for ordering them here. The server can
+// always SEARCH even if it can't SORT, but the order depends on every
+// match, so the headers of any we haven't paged in yet are fetched first.
+func (m *Mailbox) matching(criteria *Criteria) ([]*Email, error) {
+    found, err := m.Search(criteria)
+    if err != nil { return nil, err }
+
+    // in batches, so a sparse result doesn't make one enormous UID FETCH
+    emails := make([]*Email, 0, len(found.UIDs))
+    for start := 0; start < len(found.UIDs); start += headerBatch {
+        end := start + headerBatch
+        if end > len(found.UIDs) {
+            end = len(found.UIDs)
+        }
+        batch, err := m.Emails(found.UIDs[start:end])
+        if err != nil { return nil, err }
+        emails = append(emails, batch...)
+    }
+    return emails, nil
+}
+
+// how many messages' headers matching fetches at a time
+const headerBatch = 500
+
+// sorts emails by a SortKey. Like RFC 5256, REVERSE only flips the key;
+// ties are always broken by UID, lowest first.
+type emailSorter struct {
+    emails  []*Email
+    key     SortKey
+    reverse bool
+}
+
+func (s *emailSorter) Len() int      { return len(s.emails) }
+func (s *emailSorter) Swap(i, j int) { s.emails[i], s.emails[j] = s.emails[j], s.emails[i] }
+func (s *emailSorter) Less(i, j int) bool {
+    a, b := s.emails[i], s.emails[j]
+    if order := compareBy(s.key, a, b); order != 0 {
+        if s.reverse {
+            return order > 0
+        }
+        return order < 0
+    }
+    return a.UID < b.UID
+}
+
+// -1, 0 or 1 as a sorts before, with, or after b
+func compareBy(key SortKey, a, b *Email) int {
+    switch key {
+    case SortDate:
+        da, db := a.sentDate(), b.sentDate()
+        if da.Before(db) { return -1 }
+        if db.Before(da) { return 1 }
+    case SortFrom:
+        return strings.Compare(a.sortFrom(), b.sortFrom())
+    case SortSubject:
+        return strings.Compare(a.baseSubject(), b.baseSubject())
+    case SortSize:
+        za, zb := a.size(), b.size()
+        if za < zb { return -1 }
+        if za > zb { return 1 }
+    case SortArrival:
+        aa, ab := a.arrival(), b.arrival()
+        if aa.Before(ab) { return -1 }
+        if ab.Before(aa) { return 1 }
+    }
+    return 0
+}
+
+// the Date header. RFC 5256 says to use the arrival time if it's missing
+// or broken.
+func (m *Email) sentDate() time.Time {
+    if m.Summary == nil { return time.Time{} }
+    if m.Summary.Date.IsZero() {
+        return m.Summary.InternalDate
+    }
+    return m.Summary.Date
+}
+
+// the mailbox (local part) of the first From address, lowercased
+func (m *Email) sortFrom() string {
+    if m.Summary == nil || len(m.Summary.From) == 0 { return "" }
+    return strings.ToLower(m.Summary.From[0].Mailbox)
+}
+
+func (m *Email) baseSubject() string {
+    if m.Summary == nil { return "" }
+    return BaseSubject(m.Summary.Subject)
+}
+
+// message size in bytes
+func (m *Email) size() uint32 {
+    if m.Summary == nil { return 0 }
+    return m.Summary.Size
+}
+
+// when the message arrived
+func (m *Email) arrival() time.Time {
+    if m.Summary == nil { return time.Time{} }
+    return m.Summary.InternalDate
+}
+
+var (
+    // a leading "Re:", "Fwd: ", "Fw [list]:"...
+    subjectLeader = regexp.MustCompile(`^(?i)(re|fwd?)\s*(\[[^\[\]]*\])?\s*:\s*`)
+    // a leading "[list-name] "
+    subjectBlob   = regexp.MustCompile(`^\[[^\[\]]*\]\s*`)
+    // a trailing "(fwd)"
+    subjectTrailer = regexp.MustCompile(`(?i)\s*\(fwd\)\s*$`)
+    // "[fwd: subject]"
+    subjectFwd    = regexp.MustCompile(`^(?i)\[fwd:\s*(.*)\]$`)
+    whitespace    = regexp.MustCompile(`\s+`)
+)
+
+// the subject with the reply and forward noise removed, lowercased, per
+// RFC 5256 section 2.1. "Re: [list] Fwd: Hello (fwd)" -> "hello"
+func BaseSubject(subject string) string {
+    s := strings.TrimSpace(whitespace.ReplaceAllString(subject, " "))
+    for {
+        before := s
+        s = subjectTrailer.ReplaceAllString(s, "")
+        for {
+            inner := s
+            s = subjectLeader.ReplaceAllString(s, "")
+            // drop a [blob] unless it is all there is
+            if stripped := subjectBlob.ReplaceAllString(s, ""); stripped != "" {
+                s = stripped
+            }
+            if s == inner { break }
+        }
+        if m := subjectFwd.FindStringSubmatch(s); m != nil {
+            s = strings.TrimSpace(m[1])
+        }
+        if s == before { break }
+    }
+    return strings.ToLower(s)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// threads
+
+// a conversation tree. UID is 0 for a placeholder parent: a message that
+// was referred to but isn't in the mailbox
+type Thread struct {
+    UID      uint32
+    Children []*Thread
+}
+
+// every UID in the thread, parents before children
+func (t *Thread) UIDs() []uint32 {
+    uids := make([]uint32, 0)
+    if t.UID != 0 {
+        uids = append(uids, t.UID)
+    }
+    for _, child := range t.Children {
+        uids = append(uids, child.UIDs()...)
+    }
+    return uids
+}
+
+// group the messages matching criteria (nil for all) into conversations
+// using the REFERENCES algorithm. Like Sort, servers without it have the
+// headers of every match fetched so we can thread them here.
+func (m *Mailbox) Threads(criteria *Criteria) ([]*Thread, error) {
+    if err := criteria.Err(); err != nil { return nil, err }
+    c, err := m.open(true)
+    if err != nil { return nil, err }
+
+    if !c.Caps["THREAD=REFERENCES"] {
+        emails, err := m.matching(criteria)
+        if err != nil { return nil, err }
+        return threadReferences(emails), nil
+    }
+
+    args := append([]imap.Field{"REFERENCES", "UTF-8"}, criteria.fields(c)...)
+    cmd, err := imap.Wait(c.Send("UID THREAD", args...))
+    if err != nil { return nil, err }
+
+    threads := make([]*Thread, 0)
+    for _, rsp := range cmd.Data {
+        for _, f := range rsp.Fields[1:] {
+            threads = append(threads, parseThread(imap.AsList(f)))
+        }
+    }
+    return threads, nil
+}
+
+// parse one thread from a THREAD response. In "(3 6 (4 23)(44 7 96))",
+// each number is the child of the one before it, and the nested lists are
+// sibling branches hanging off the last number.
+func parseThread(list []imap.Field) *Thread {
+    root := &Thread{}
+    parent := root
+    for i, f := range list {
+        if imap.TypeOf(f) == imap.List {
+            parent.Children = append(parent.Children, parseThread(imap.AsList(f)))
+            continue
+        }
+        uid := imap.AsNumber(f)
+        if i == 0 {
+            root.UID = uid
+            continue
+        }
+        child := &Thread{UID: uid}
+        parent.Children = append(parent.Children, child)
+        parent = child
+    }
+
+    // a list that starts with branches has no common parent in the mailbox
+    return root
+}
+
+// a node in the local threading table
+type threadContainer struct {
+    email    *Email
+    parent   *threadContainer
+    children []*threadContainer
+}
+
+// is c an ancestor of (or the same as) other?
+func (c *threadContainer) reaches(other *threadContainer) bool {
+    for p := other; p != nil; p = p.parent {
+        if p == c { return true }
+    }
+    return false
+}
+
+func (c *threadContainer) setParent(parent *threadContainer) {
+    if c.parent == parent || c.reaches(parent) { return }
+    if c.parent != nil {
+        siblings := c.parent.children
+        for i, s := range siblings {
+            if s == c {
+                c.parent.children = append(siblings[:i], siblings[i+1:]...)
+                break
+            }
+        }
+    }
+    c.parent = parent
+    if parent != nil {
+        parent.children = append(parent.children, c)
+    }
+}
+
+// message IDs like <abc@example.com>, as found in References
+var messageIDs = regexp.MustCompile(`<[^<>]+>`)
+
+// the References algorithm from RFC 5256 section 4
+func threadReferences(emails []*Email) []*Thread {
+    table := make(map[string]*threadContainer)
+    get := func(id string) *threadContainer {
+        if c, ok := table[id]; ok { return c }
+        c := &threadContainer{}
+        table[id] = c
+        return c
+    }
+
+    // containers for messages without a usable Message-ID
+    anonymous := make([]*threadContainer, 0)
+    for _, email := range emails {
+        if email.Summary == nil { continue }
+        id := strings.TrimSpace(email.Summary.MessageID)
+        var c *threadContainer
+        if id == "" || (table[id] != nil && table[id].email != nil) {
+            // no ID, or a duplicate: give it a container of its own
+            c = &threadContainer{}
+            anonymous = append(anonymous, c)
+        } else {
+            c = get(id)
+        }
+        c.email = email
+
+        refs := email.Summary.References
+        if len(refs) == 0 {
+            refs = messageIDs.FindAllString(email.Summary.InReplyTo, 1)
+        }
+
+        // link the references together, parent to child
+        var prev *threadContainer
+        for _, ref := range refs {
+            ref := get(ref)
+            if prev != nil && ref.parent == nil {
+                ref.setParent(prev)
+            }
+            prev = ref
+        }
+        c.setParent(prev)
+    }
+
+    roots := make([]*threadContainer, 0)
+    for _, c := range table {
+        if c.parent == nil {
+            roots = append(roots, c)
+        }
+    }
+    for _, c := range anonymous {
+        if c.parent == nil {
+            roots = append(roots, c)
+        }
+    }
+
+    threads := make([]*Thread, 0, len(roots))
+    for _, root := range roots {
+        threads = append(threads, root.prune()...)
+    }
+    byUID := emailsByUID(emails)
+    // so a placeholder's subject is its oldest child's
+    sortThreads(threads, byUID)
+    threads = gatherBySubject(threads, byUID)
+    sortThreads(threads, byUID)
+    return threads
+}
+
+// gather threads whose roots have the same base subject under one root,
+// since they're most likely one conversation that lost its References
+// (RFC 5256 section 4, step 5). Merged threads are changed in place.
+func gatherBySubject(threads []*Thread, emails map[uint32]*Email) []*Thread {
+    // base subject of a thread, and whether it's a reply or forward
+    subjectOf := func(t *Thread) (string, bool) {
+        if t.UID == 0 && len(t.Children) > 0 {
+            t = t.Children[0]
+        }
+        email := emails[t.UID]
+        if email == nil || email.Summary == nil { return "", false }
+        return BaseSubject(email.Summary.Subject), isReplySubject(email.Summary.Subject)
+    }
+
+    // the thread each subject gathers under: a placeholder if there is
+    // one, or else one that isn't a reply
+    table := make(map[string]*Thread)
+    for _, t := range threads {
+        subject, reply := subjectOf(t)
+        if subject == "" { continue }
+        old, ok := table[subject]
+        if !ok {
+            table[subject] = t
+        } else if old.UID != 0 {
+            _, oldReply := subjectOf(old)
+            if t.UID == 0 || (oldReply && !reply) {
+                table[subject] = t
+            }
+        }
+    }
+
+    gathered := make([]*Thread, 0, len(threads))
+    for _, t := range threads {
+        subject, reply := subjectOf(t)
+        into := table[subject]
+        if subject == "" || into == t {
+            gathered = append(gathered, t)
+            continue
+        }
+        _, intoReply := subjectOf(into)
+
+        switch {
+        case into.UID == 0 && t.UID == 0:
+            into.Children = append(into.Children, t.Children...)
+        case into.UID == 0:
+            into.Children = append(into.Children, t)
+        case t.UID == 0:
+            old := *into
+            *into = Thread{Children: append(t.Children, &old)}
+        case !intoReply && reply:
+            into.Children = append(into.Children, t)
+        default:
+            // siblings under a new placeholder
+            old := *into
+            *into = Thread{Children: []*Thread{&old, t}}
+        }
+    }
+    return gathered
+}
+
+// did the subject have Re:, Fwd: or the like taken off to get its base
+// subject? A [list] tag doesn't count.
+func isReplySubject(subject string) bool {
+    s := strings.TrimSpace(whitespace.ReplaceAllString(subject, " "))
+    s = subjectBlob.ReplaceAllString(s, "")
+    return subjectLeader.MatchString(s) || subjectTrailer.MatchString(s) || subjectFwd.MatchString(s)
+}
+
+// turn a container tree into Threads, dropping placeholders that have
+// nothing to say: empty leaves vanish, and an empty container with one
+// child is replaced by that child.
+func (c *threadContainer) prune() []*Thread {
+    children := make([]*Thread, 0, len(c.children))
+    for _, child := range c.children {
+        children = append(children, child.prune()...)
+    }
+
+    if c.email != nil {
+        return []*Thread{{UID: c.email.UID, Children: children}}
+    }
+    if len(children) <= 1 || c.parent != nil {
+        // promote children, except at the root where a placeholder
+        // keeps siblings together
+        return children
+    }
+    return []*Thread{{Children: children}}
+}
+
+func emailsByUID(emails []*Email) map[uint32]*Email {
+    byUID := make(map[uint32]*Email, len(emails))
+    for _, email := range emails {
+        byUID[email.UID] = email
+    }
+    return byUID
+}
+
+// order threads and their children by the date of their first message
+func sortThreads(threads []*Thread, emails map[uint32]*Email) {
+    for _, t := range threads {
+        sortThreads(t.Children, emails)
+    }
+    sort.Sort(&threadSorter{threads, emails})
+}
+
+type threadSorter struct {
+    threads []*Thread
+    emails  map[uint32]*Email
+}
+
+// the message that represents a thread when sorting: the root, or its
+// first child if the root is a placeholder
+func (s *threadSorter) first(t *Thread) *Email {
+    for t.UID == 0 && len(t.Children) > 0 {
+        t = t.Children[0]
+    }
+    return s.emails[t.UID]
+}
+
+func (s *threadSorter) Len() int      { return len(s.threads) }
+func (s *threadSorter) Swap(i, j int) { s.threads[i], s.threads[j] = s.threads[j], s.threads[i] }
+func (s *threadSorter) Less(i, j int) bool {
+    a, b := s.first(s.threads[i]), s.first(s.threads[j])
+    if a == nil || b == nil { return a == nil && b != nil }
+    if da, db := a.sentDate(), b.sentDate(); !da.Equal(db) {
+        return da.Before(db)
+    }
+    return a.UID < b.UID
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// a message for threading, sent uid days after the epoch
+func threadEmail(uid uint32, id, subject string, refs ...string) *Email {
+    summary := &Summary{References: refs}
+    summary.MessageID = id
+    summary.Subject = subject
+    summary.Date = time.Unix(int64(uid) * 86400, 0)
+    return &Email{UID: uid, Summary: summary}
+}
+
+func TestThreadReferencesGathersSubjects(t *testing.T) {
+    tests := []struct {
+        name   string
+        emails []*Email
+        want   []*Thread
+    }{
+        {"reply without References goes under the original",
+            []*Email{
+                threadEmail(1, "<a@x>", "Lunch"),
+                threadEmail(2, "<b@x>", "Re: Lunch"),
+                threadEmail(3, "<c@x>", "Other"),
+            },
+            []*Thread{
+                {UID: 1, Children: []*Thread{{UID: 2}}},
+                {UID: 3},
+            }},
+        {"two originals become siblings",
+            []*Email{
+                threadEmail(1, "<a@x>", "Lunch"),
+                threadEmail(2, "<b@x>", "[team] lunch"),
+            },
+            []*Thread{
+                {Children: []*Thread{{UID: 1}, {UID: 2}}},
+            }},
+        {"References still win",
+            []*Email{
+                threadEmail(1, "<a@x>", "Lunch"),
+                threadEmail(2, "<b@x>", "Re: Lunch", "<a@x>"),
+                threadEmail(3, "<c@x>", "Re: Lunch", "<b@x>"),
+            },
+            []*Thread{
+                {UID: 1, Children: []*Thread{{UID: 2, Children: []*Thread{{UID: 3}}}}},
+            }},
+        {"replies to a missing message join its placeholder",
+            []*Email{
+                threadEmail(1, "<b@x>", "Re: Lunch", "<a@x>"),
+                threadEmail(2, "<c@x>", "Re: Lunch", "<a@x>"),
+                threadEmail(3, "<d@x>", "Fwd: Lunch"),
+            },
+            []*Thread{
+                {Children: []*Thread{{UID: 1}, {UID: 2}, {UID: 3}}},
+            }},
+        {"no subject isn't a subject",
+            []*Email{
+                threadEmail(1, "<a@x>", ""),
+                threadEmail(2, "<b@x>", "Re:"),
+            },
+            []*Thread{
+                {UID: 1},
+                {UID: 2},
+            }},
+    }
+
+    for _, test := range tests {
+        got, want := threadString(threadReferences(test.emails)), threadString(test.want)
+        if got != want {
+            t.Errorf("%s: got %s, want %s", test.name, got, want)
+        }
+    }
+}
+
+// threads as "(1 (2)(3))", placeholders as 0
+func threadString(threads []*Thread) string {
+    s := ""
+    for _, t := range threads {
+        s += "(" + strconv.Itoa(int(t.UID))
+        if len(t.Children) > 0 {
+            s += " " + threadString(t.Children)
+        }
+        s += ")"
+    }
+    return s
+}
+
+func TestBaseSubject(t *testing.T) {
+    tests := []struct {
+        in   string
+        want string
+    }{
+        {"Hello", "hello"},
+        {"Re: [list] Fwd: Hello (fwd)", "hello"},
+        {"RE:  re : Hi", "hi"},
+        {"Fw[list]: news", "news"},
+        {"[list] [tag] Subject", "subject"},
+        {"[only a blob]", "[only a blob]"},
+        {"[Fwd: Original]", "original"},
+        {"Re: [Fwd: Original] (fwd)", "original"},
+        {"  lots \t of   space ", "lots of space"},
+        {"Re:", ""},
+        {"", ""},
+    }
+
+    for _, test := range tests {
+        if got := BaseSubject(test.in); got != test.want {
+            t.Errorf("BaseSubject(%q) = %q, want %q", test.in, got, test.want)
+        }
+    }
+}
+
+// four messages, none of them loaded before Sort or Threads is called
+var orderingMail = fetchSummary(1, "Tue, 3 Jan 2006 10:00:00 +0000", "carol", "Re: beta", 300) +
+    fetchSummary(2, "Sun, 1 Jan 2006 10:00:00 +0000", "Alice", "gamma", 100) +
+    fetchSummary(3, "Mon, 2 Jan 2006 10:00:00 +0000", "bob", "[list] Alpha", 200) +
+    fetchSummary(4, "Mon, 2 Jan 2006 10:00:00 +0000", "alice", "Fwd: alpha", 200)
+
+func orderingReply(command string) string {
+    switch {
+    case strings.HasPrefix(command, "UID SEARCH"):
+        return "* SEARCH 1 2 3 4\r\n"
+    case strings.HasPrefix(command, "UID FETCH"):
+        return orderingMail
+    }
+    return ""
+}
+
+func TestSortLocally(t *testing.T) {
+    tests := []struct {
+        key     SortKey
+        reverse bool
+        want    string
+    }{
+        // ties are broken by UID, even in reverse
+        {SortDate, false, "[2 3 4 1]"},
+        {SortDate, true, "[1 3 4 2]"},
+        {SortFrom, false, "[2 4 3 1]"},
+        {SortSubject, false, "[3 4 1 2]"},
+        {SortSize, true, "[1 3 4 2]"},
+    }
+
+    for _, test := range tests {
+        m, f := newFakeMailbox(t, "", 4, orderingReply)
+        uids, err := m.Sort(test.key, test.reverse, nil)
+        f.Close()
+        if err != nil {
+            t.Errorf("%s: %v", test.key, err)
+        } else if got := fmt.Sprint(uids); got != test.want {
+            t.Errorf("%s (reverse %v): got %s, want %s", test.key, test.reverse, got, test.want)
+        }
+    }
+}
+
+func TestThreadsLocally(t *testing.T) {
+    m, f := newFakeMailbox(t, "", 4, orderingReply)
+    defer f.Close()
+
+    threads, err := m.Threads(nil)
+    if err != nil { t.Fatal(err) }
+    if got, want := threadString(threads), "(2)(3 (4))(1)"; got != want {
+        t.Errorf("got %s, want %s", got, want)
+    }
+}
+
+func TestParseThread(t *testing.T) {
+    m, f := newFakeMailbox(t, "THREAD=REFERENCES", 8, func(command string) string {
+        if strings.HasPrefix(command, "UID THREAD") {
+            return "* THREAD (2)(3 6 (4 23)(44 7 96))((11)(12 13))\r\n"
+        }
+        return ""
+    })
+    defer f.Close()
+
+    threads, err := m.Threads(nil)
+    if err != nil { t.Fatal(err) }
+    // a list that starts with branches hangs them off a placeholder
+    want := "(2)(3 (6 (4 (23))(44 (7 (96)))))(0 (11)(12 (13)))"
+    if got := threadString(threads); got != want {
+        t.Errorf("got %s, want %s", got, want)
+    }
+}
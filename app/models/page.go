@@ -0,0 +1,216 @@
+package models
+
+// newest-first paging through a mailbox by sequence number, so we never
+// have to download 30k headers to show the first screen of mail.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "sort"
+)
+
+// one screenful of messages
+type MessagePage struct {
+    // newest first
+    Messages []*Email
+    // number of messages in the mailbox
+    Total    uint32
+    // UID to pass as `before` to get the next (older) page.
+    // 0 when this is the last page
+    Next     uint32
+    // mailbox token, for asking for changes later
+    Token    string
+}
+
+// get up to `limit` messages older than the message with UID `before`,
+// newest first. before = 0 starts at the newest message.
+func (m *Mailbox) Page(limit int, before uint32) (*MessagePage, error) {
+    c, err := m.open(true)
+    if err != nil { return nil, err }
+
+    // anything we load or refresh counts as a change for token holders
+    m.generation++
+
+    page := &MessagePage{
+        Messages: make([]*Email, 0),
+        Total: c.Mailbox.Messages,
+    }
+
+    // sequence number of the newest message in the window
+    top := page.Total
+    if before != 0 {
+        top, err = m.countBefore(c, before)
+        if err != nil { return nil, err }
+    }
+    if top == 0 || limit <= 0 {
+        page.Token = m.Token()
+        return page, nil
+    }
+
+    low := uint32(1)
+    if top > uint32(limit) {
+        low = top - uint32(limit) + 1
+    }
+
+    // find out which UIDs are in the window, then only download the
+    // headers we don't have yet
+    seqs := &imap.SeqSet{}
+    seqs.AddRange(low, top)
+    cmd, err := imap.Wait(c.Fetch(seqs, "UID", "FLAGS"))
+    if err != nil { return nil, err }
+
+    uids := make([]uint32, 0, limit)
+    missing := &imap.SeqSet{}
+    for _, rsp := range cmd.Data {
+        info := rsp.MessageInfo()
+        if info.UID == 0 { continue }
+        uids = append(uids, info.UID)
+        if email, ok := m.Mail[info.UID]; ok {
+            email.updateFlags(info.Flags)
+        } else {
+            missing.AddNum(info.UID)
+        }
+    }
+
+    if !missing.Empty() {
+        if _, err := m.backfill(c, missing); err != nil { return nil, err }
+    }
+
+    // UIDs grow with sequence numbers, so newest first is highest UID first
+    sort.Sort(sort.Reverse(uidSlice(uids)))
+    for _, uid := range uids {
+        if email, ok := m.Mail[uid]; ok {
+            page.Messages = append(page.Messages, email)
+        }
+    }
+
+    if low > 1 && len(uids) > 0 {
+        page.Next = uids[len(uids) - 1]
+    }
+    page.Token = m.Token()
+    return page, nil
+}
+
+// load the headers of messages we haven't yet. The ones up to the newest
+// we'd already seen were there all along, so they aren't news to token
+// holders, and don't show up in anyone's Added.
+func (m *Mailbox) backfill(c *imap.Client, set *imap.SeqSet) ([]*Email, error) {
+    latest := m.latestMessage
+    loaded, err := m.fetchHeaders(c, set)
+    if err != nil { return nil, err }
+    for _, email := range loaded {
+        if email.UID <= latest {
+            email.added, email.changed = 0, 0
+        }
+    }
+    return loaded, nil
+}
+
+// how many messages have a UID lower than `uid`? Sequence numbers are
+// dense, so that's also the sequence number of the message just before it.
+// With ESEARCH the server counts them; without it, it lists them all.
+func (m *Mailbox) countBefore(c *imap.Client, uid uint32) (uint32, error) {
+    if uid <= 1 { return 0, nil }
+
+    set := &imap.SeqSet{}
+    set.AddRange(1, uid - 1)
+    if c.Caps["ESEARCH"] {
+        result, err := m.esearch(c, NewCriteria().atoms("UID", set), "COUNT")
+        if err != nil { return 0, err }
+        return result.Count, nil
+    }
+
+    cmd, err := imap.Wait(c.UIDSearch("UID", set))
+    if err != nil { return 0, err }
+
+    count := uint32(0)
+    for _, rsp := range cmd.Data {
+        count += uint32(len(rsp.SearchResults()))
+    }
+    return count, nil
+}
+
+// page through an already-ordered list of UIDs, like the result of Sort.
+// before is the last UID of the previous page, or 0 to start at the top.
+func (m *Mailbox) PageOf(uids []uint32, limit int, before uint32) (*MessagePage, error) {
+    start, end := pageBounds(len(uids), limit, func(i int) bool {
+        return uids[i] == before
+    }, before != 0)
+
+    messages, err := m.Emails(uids[start:end])
+    if err != nil { return nil, err }
+
+    page := &MessagePage{
+        Messages: messages,
+        Total: uint32(len(uids)),
+        Token: m.Token(),
+    }
+    if end < len(uids) {
+        page.Next = uids[end - 1]
+    }
+    return page, nil
+}
+
+// a screenful of conversations
+type ThreadPage struct {
+    Threads  []*Thread
+    // every message in Threads
+    Messages []*Email
+    // number of threads
+    Total    uint32
+    // first UID of the last thread on this page, to pass as `before` for
+    // the next page. 0 when this is the last page
+    Next     uint32
+    Token    string
+}
+
+// page through a list of threads, like the result of Threads.
+// threads are named by their first UID for the `before` cursor.
+func (m *Mailbox) ThreadPage(threads []*Thread, limit int, before uint32) (*ThreadPage, error) {
+    first := func(i int) uint32 {
+        if uids := threads[i].UIDs(); len(uids) > 0 {
+            return uids[0]
+        }
+        return 0
+    }
+    start, end := pageBounds(len(threads), limit, func(i int) bool {
+        return first(i) == before
+    }, before != 0)
+
+    uids := make([]uint32, 0)
+    for _, t := range threads[start:end] {
+        uids = append(uids, t.UIDs()...)
+    }
+    messages, err := m.Emails(uids)
+    if err != nil { return nil, err }
+
+    page := &ThreadPage{
+        Threads: threads[start:end],
+        Messages: messages,
+        Total: uint32(len(threads)),
+        Token: m.Token(),
+    }
+    if end < len(threads) {
+        page.Next = first(end - 1)
+    }
+    return page, nil
+}
+
+// figure out the slice [start:end] of a list of n things for a page.
+// the page starts just after the item matching `isCursor`, if hasCursor.
+// a cursor that isn't in the list starts from the top again.
+func pageBounds(n, limit int, isCursor func(int) bool, hasCursor bool) (int, int) {
+    start := 0
+    if hasCursor {
+        for i := 0; i < n; i++ {
+            if isCursor(i) {
+                start = i + 1
+                break
+            }
+        }
+    }
+    end := start + limit
+    if end > n || limit <= 0 {
+        end = n
+    }
+    return start, end
+}
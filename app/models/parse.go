@@ -0,0 +1,375 @@
+package models
+
+// parsing whole messages without holding them in memory. Each part is read
+// once into a spool: memory while it's small, a temporary file once it
+// isn't. Big leaf parts are then decoded as they're read, straight from
+// their spool, and multiparts drop theirs once their children are parsed.
+// Parts and messages over their size limits are cut short, not refused.
+// That bounds what parsing holds on top of its input; when the input is a
+// body already in memory (Email.ParseBody), so is all of that.
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "mime/multipart"
+    "net/mail"
+    "os"
+    "runtime"
+
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/transform"
+)
+
+// how much parsing a message may take. Sizes are in bytes; 0 is no limit.
+type ParseLimits struct {
+    // parts bigger than this are cut short
+    MaxPartSize  int64
+    // so are messages bigger than this
+    MaxTotalSize int64
+    // parts bigger than this are kept in temporary files, not memory. 0
+    // keeps every part in memory.
+    SpoolSize    int64
+    // multiparts and attached messages nested deeper than this are left
+    // as they are
+    MaxDepth     int
+    // where the temporary files go; "" for the system default
+    TempDir      string
+}
+
+// the limits MessageToNode and DataToNode parse with. Set from app.conf
+// at startup.
+var DefaultParseLimits = ParseLimits{
+    MaxPartSize:  64 << 20,
+    MaxTotalSize: 128 << 20,
+    SpoolSize:    1 << 20,
+    MaxDepth:     20,
+}
+
+// a part or message that was over a size limit, and was cut short
+type LimitError struct {
+    What  string
+    Limit int64
+}
+
+func (e *LimitError) Error() string {
+    return fmt.Sprintf("%s is over the %d byte limit, cut short", e.What, e.Limit)
+}
+
+// parse a message within some limits. Like MessageToNode, the tree comes
+// back even when there are errors.
+func ParseMessage(r io.Reader, limits ParseLimits) (*MessageNode, error) {
+    msg, err := mail.ReadMessage(r)
+    if err != nil { return nil, err }
+    return (&parser{limits}).message(msg.Header, msg.Body)
+}
+
+type parser struct {
+    limits ParseLimits
+}
+
+// parse a message's body, under the total size limit
+func (p *parser) message(header mail.Header, body io.Reader) (*MessageNode, error) {
+    if p.limits.MaxTotalSize <= 0 {
+        return p.node(header, body, 0)
+    }
+
+    total := &totalReader{r: body, left: p.limits.MaxTotalSize}
+    node, err := p.node(header, total, 0)
+    if total.over {
+        node.Truncated = true
+        // whatever else went wrong was most likely because of this
+        return node, &LimitError{"message", p.limits.MaxTotalSize}
+    }
+    return node, err
+}
+
+// parse one part, and its children
+func (p *parser) node(header mail.Header, body io.Reader, depth int) (*MessageNode, error) {
+    node := &MessageNode{Header: header}
+
+    ct, params, err := parseMediaType(header.Get(ContentType))
+    if err == nil {
+        node.ContentType = ct
+        node.ContentTypeParams = params
+        node.Filename = node.filename()
+    }
+
+    // containers are as big as their children, so only the total limit
+    // applies to them
+    boundary, isMultipart := node.ContentTypeParams[Boundary]
+    limit := p.limits.MaxPartSize
+    if isMultipart || IsMessageType(ct) {
+        limit = 0
+    }
+
+    sp, readErr := p.spool(body, limit)
+    if sp == nil { return node, readErr }
+    if _, ok := readErr.(*LimitError); ok {
+        node.Truncated = true
+    } else if readErr != nil {
+        // a part that ends early is still worth showing
+        debug("error reading part: ", readErr)
+    }
+
+    if (isMultipart || IsMessageType(ct)) && depth >= p.limits.MaxDepth && p.limits.MaxDepth > 0 {
+        p.setBody(node, sp)
+        return node, fmt.Errorf("parts nested more than %d deep", p.limits.MaxDepth)
+    }
+
+    switch {
+    case isMultipart:
+        if err := p.multipart(node, sp, boundary, depth); err != nil {
+            return node, err
+        }
+        return node, readErr
+
+    case IsMessageType(ct):
+        if parsed, err := p.attached(node, sp, depth); parsed {
+            if err != nil { return node, err }
+            return node, readErr
+        }
+    }
+
+    p.setBody(node, sp)
+    return node, readErr
+}
+
+// parse a multipart's children out of its spooled body. If it's broken,
+// the children we got are kept, along with the raw body so nothing is lost.
+func (p *parser) multipart(node *MessageNode, sp *spool, boundary string, depth int) error {
+    multi := multipart.NewReader(sp.reader(), boundary)
+    childErrs := make(ChildError)
+    node.Children = make([]*MessageNode, 0, 5)
+
+    // raw parts, so quoted-printable is left for us to decode and we know
+    // what the encoding was
+    for {
+        part, err := multi.NextRawPart()
+        if err == io.EOF { break }
+        if err != nil {
+            debug("error occured while making part: ", part, " error: ", err)
+            node.Body = NewMarshalReader(sp.reader())
+            node.spool = sp
+            return fmt.Errorf("Aborted Multipart#NextPart at error: %v", err)
+        }
+
+        child, err := p.node(mail.Header(part.Header), part, depth + 1)
+        if err != nil {
+            childErrs[child] = err
+        }
+        node.Children = append(node.Children, child)
+    }
+
+    // don't need this data anymore, since we have the children
+    sp.Close()
+
+    if len(childErrs) > 0 {
+        return childErrs
+    }
+    return nil
+}
+
+// parse an attached message as our only child. false if it isn't a
+// message after all, and should be left as a plain part.
+func (p *parser) attached(node *MessageNode, sp *spool, depth int) (bool, error) {
+    // message/global may be encoded; message/rfc822 can't be
+    r, _ := decodingReader(transferEncoding(node.Header), sp.reader())
+    inner, err := mail.ReadMessage(r)
+    if err != nil {
+        debug("could not read attached message: ", err)
+        return false, nil
+    }
+
+    child, err := p.node(inner.Header, inner.Body, depth + 1)
+    node.Children = []*MessageNode{child}
+    sp.Close()
+    if err != nil {
+        return true, ChildError{child: err}
+    }
+    return true, nil
+}
+
+// give a leaf part its body. Small ones are decoded in memory by SetBody;
+// big ones are decoded as they're read, and keep their spool.
+func (p *parser) setBody(node *MessageNode, sp *spool) {
+    if sp.file == nil {
+        node.SetBody(sp.mem)
+        return
+    }
+
+    node.Encoding = transferEncoding(node.Header)
+    node.spool = sp
+
+    // decode it once now, so reading the Body later can't fail part way.
+    // Like SetBody, a damaged end is dropped and the rest kept, and a part
+    // we can't decode any of is kept as it is.
+    n, err := io.Copy(ioutil.Discard, p.content(node, sp))
+    if err != nil {
+        debug("could not decode ", node.Encoding, " body: ", err)
+        if n == 0 {
+            node.Encoded = true
+        } else {
+            node.Truncated = true
+        }
+    }
+
+    if node.Encoded {
+        node.Body = NewMarshalReader(sp.reader())
+    } else {
+        node.Body = NewMarshalReader(partialReader{p.content(node, sp)})
+    }
+    node.Body.MarshalAsString = IsText(node)
+
+    if node.ContentType == TypeHTML && !node.Encoded {
+        node.Sanitized = SanitizeHTML(partialReader{p.content(node, sp)})
+    }
+}
+
+// ends where the data stops decoding, instead of failing
+type partialReader struct {
+    r io.Reader
+}
+
+func (p partialReader) Read(b []byte) (int, error) {
+    n, err := p.r.Read(b)
+    if err != nil && err != io.EOF {
+        debug("part ends early: ", err)
+        err = io.EOF
+    }
+    return n, err
+}
+
+// a fresh reader for a spooled leaf's content: decoded, and converted to
+// UTF-8 if it's text in a charset we know. There's too much of it to
+// guess the charset of.
+func (p *parser) content(node *MessageNode, sp *spool) io.Reader {
+    r, ok := decodingReader(node.Encoding, sp.reader())
+    node.Encoded = !ok
+    if !ok || !IsText(node) {
+        return r
+    }
+    enc := lookupCharset(node.ContentTypeParams["charset"])
+    if enc == nil || enc == encoding.Nop {
+        return r
+    }
+    return transform.NewReader(r, enc.NewDecoder())
+}
+
+// read a part into a spool, up to limit bytes (0 for no limit). A spool
+// with what was read comes back with any error, unless there's nowhere to
+// put it.
+func (p *parser) spool(r io.Reader, limit int64) (*spool, error) {
+    if limit > 0 {
+        // one more byte, to tell if there was more
+        r = io.LimitReader(r, limit + 1)
+    }
+
+    s := &spool{}
+    var buf bytes.Buffer
+    head := r
+    if p.limits.SpoolSize > 0 {
+        head = io.LimitReader(r, p.limits.SpoolSize + 1)
+    }
+    n, err := buf.ReadFrom(head)
+    s.size = n
+
+    if n <= p.limits.SpoolSize || p.limits.SpoolSize <= 0 || err != nil {
+        s.mem = buf.Bytes()
+    } else {
+        // too big for memory
+        file, ferr := ioutil.TempFile(p.limits.TempDir, "mail-part-")
+        if ferr != nil { return nil, ferr }
+        s.file = file
+        runtime.SetFinalizer(s, (*spool).Close)
+
+        if _, err = buf.WriteTo(file); err == nil {
+            n, err = io.Copy(file, r)
+            s.size += n
+        }
+    }
+
+    if limit > 0 && s.size > limit {
+        if terr := s.truncate(limit); terr != nil { return s, terr }
+        return s, &LimitError{"part", limit}
+    }
+    return s, err
+}
+
+//////// spools ////////
+
+// a part's raw data, in memory or in a temporary file
+type spool struct {
+    mem  []byte
+    file *os.File
+    size int64
+}
+
+// a new reader for the data, from the start
+func (s *spool) reader() io.ReadSeeker {
+    if s.file != nil {
+        return io.NewSectionReader(s.file, 0, s.size)
+    }
+    return bytes.NewReader(s.mem)
+}
+
+func (s *spool) truncate(size int64) error {
+    s.size = size
+    if s.file != nil {
+        return s.file.Truncate(size)
+    }
+    s.mem = s.mem[:size]
+    return nil
+}
+
+// delete the temporary file, if there is one
+func (s *spool) Close() error {
+    if s.file == nil { return nil }
+    name := s.file.Name()
+    err := s.file.Close()
+    if rerr := os.Remove(name); err == nil {
+        err = rerr
+    }
+    s.file = nil
+    return err
+}
+
+// counts down what's left of the total size limit, and notices if the
+// message goes on past it
+type totalReader struct {
+    r    io.Reader
+    left int64
+    over bool
+}
+
+func (t *totalReader) Read(b []byte) (int, error) {
+    if t.left <= 0 {
+        var probe [1]byte
+        if n, _ := t.r.Read(probe[:]); n > 0 {
+            t.over = true
+        }
+        return 0, io.EOF
+    }
+    if int64(len(b)) > t.left {
+        b = b[:t.left]
+    }
+    n, err := t.r.Read(b)
+    t.left -= int64(n)
+    return n, err
+}
+
+// delete the temporary files behind this tree's big parts. Their Bodies
+// can't be read afterwards.
+func (node *MessageNode) Close() error {
+    var err error
+    node.ForEach(func(part *MessageNode) {
+        if part.spool != nil {
+            if cerr := part.spool.Close(); err == nil {
+                err = cerr
+            }
+            part.spool = nil
+        }
+    })
+    return err
+}
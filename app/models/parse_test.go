@@ -0,0 +1,228 @@
+package models
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+)
+
+// n bytes of something that isn't all the same byte
+func testData(n int) []byte {
+    data := make([]byte, n)
+    for i := range data {
+        data[i] = byte(i * 7)
+    }
+    return data
+}
+
+// base64 in 76 character lines, like a mailer would send it
+func testBase64(data []byte) string {
+    encoded := base64.StdEncoding.EncodeToString(data)
+    lines := make([]string, 0)
+    for len(encoded) > 76 {
+        lines = append(lines, encoded[:76])
+        encoded = encoded[76:]
+    }
+    lines = append(lines, encoded)
+    return strings.Join(lines, "\r\n")
+}
+
+func TestParseLimits(t *testing.T) {
+    data := testData(3000)
+    attachment := "Content-Type: application/octet-stream\r\n" +
+        "Content-Transfer-Encoding: base64\r\n\r\n" + testBase64(data)
+    text := "Content-Type: text/plain\r\n\r\n" + strings.Repeat("a line of text\r\n", 125)
+
+    tests := []struct {
+        name      string
+        limits    ParseLimits
+        raw       string
+        spooled   bool
+        truncated bool
+        // the decoded body is this much of want
+        want      []byte
+        length    int
+    }{
+        {"small part in memory", ParseLimits{SpoolSize: 1 << 20}, attachment, false, false, data, 3000},
+        {"big part spooled", ParseLimits{SpoolSize: 100}, attachment, true, false, data, 3000},
+        {"spool size 0 never spools", ParseLimits{}, attachment, false, false, data, 3000},
+        {"truncated in memory", ParseLimits{MaxPartSize: 1000, SpoolSize: 1 << 20}, text, false, true,
+            []byte(strings.Repeat("a line of text\r\n", 125)), 1000},
+        {"truncated and spooled", ParseLimits{MaxPartSize: 1000, SpoolSize: 100}, text, true, true,
+            []byte(strings.Repeat("a line of text\r\n", 125)), 1000},
+        // cut mid-group, so the base64 doesn't end cleanly
+        {"truncated spooled base64", ParseLimits{MaxPartSize: 1003, SpoolSize: 100}, attachment, true, true,
+            data, 732},
+        {"truncated base64 in memory", ParseLimits{MaxPartSize: 1003, SpoolSize: 1 << 20}, attachment, false, true,
+            data, 734},
+    }
+
+    for _, test := range tests {
+        node, err := ParseMessage(strings.NewReader(test.raw), test.limits)
+        if node == nil {
+            t.Errorf("%s: no tree: %v", test.name, err)
+            continue
+        }
+        _, isLimit := err.(*LimitError)
+        if test.truncated != isLimit {
+            t.Errorf("%s: error %v", test.name, err)
+        }
+        if node.Truncated != test.truncated {
+            t.Errorf("%s: Truncated is %v", test.name, node.Truncated)
+        }
+        if spooled := node.spool != nil && node.spool.file != nil; spooled != test.spooled {
+            t.Errorf("%s: spooled is %v", test.name, spooled)
+        }
+
+        // the whole tree has to marshal, however it was cut
+        if _, err := json.Marshal(node); err != nil {
+            t.Errorf("%s: marshal: %v", test.name, err)
+        }
+        body, err := node.Body.Data()
+        if err != nil {
+            t.Errorf("%s: body: %v", test.name, err)
+        } else if !bytes.Equal(body, test.want[:test.length]) {
+            t.Errorf("%s: body is %d bytes, want the first %d", test.name, len(body), test.length)
+        }
+        node.Close()
+    }
+}
+
+func TestParseMalformedMultipart(t *testing.T) {
+    tests := []struct {
+        name     string
+        body     string
+        children int
+    }{
+        {"no closing boundary",
+            "--b\r\nContent-Type: text/plain\r\n\r\nfirst\r\n--b\r\nContent-Type: text/plain\r\n\r\nsecond\r\n", 2},
+        {"bad part header",
+            "--b\r\nContent-Type: text/plain\r\n\r\nfirst\r\n--b\r\nno colon here\r\n\r\nsecond\r\n--b--\r\n", 1},
+        {"no parts at all",
+            "just some text\r\n", 0},
+    }
+
+    for _, test := range tests {
+        raw := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" + test.body
+        for _, spool := range []int64{1 << 20, 10} {
+            node, err := ParseMessage(strings.NewReader(raw), ParseLimits{SpoolSize: spool})
+            if node == nil {
+                t.Errorf("%s: no tree: %v", test.name, err)
+                continue
+            }
+            if len(node.Children) != test.children {
+                t.Errorf("%s (spool %d): %d children, want %d", test.name, spool, len(node.Children), test.children)
+            }
+            if len(node.Children) > 0 {
+                if first, _ := node.Children[0].Body.Data(); string(first) != "first" {
+                    t.Errorf("%s (spool %d): first part is %q", test.name, spool, first)
+                }
+            }
+            // what we couldn't parse is kept, so nothing is lost
+            if err == nil || node.Body == nil {
+                t.Errorf("%s (spool %d): broken multipart not reported (%v)", test.name, spool, err)
+            } else if data, _ := node.Body.Data(); !bytes.Equal(data, []byte(test.body)) {
+                t.Errorf("%s (spool %d): raw body is %q", test.name, spool, data)
+            }
+            if _, err := json.Marshal(node); err != nil {
+                t.Errorf("%s (spool %d): marshal: %v", test.name, spool, err)
+            }
+            node.Close()
+        }
+    }
+}
+
+func TestCloseDeletesTempFiles(t *testing.T) {
+    dir, err := ioutil.TempDir("", "parse-test-")
+    if err != nil { t.Fatal(err) }
+    defer os.RemoveAll(dir)
+
+    part := "--b\r\nContent-Type: application/octet-stream\r\n" +
+        "Content-Transfer-Encoding: base64\r\n\r\n" + testBase64(testData(3000)) + "\r\n"
+    raw := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" + part + part + "--b--\r\n"
+
+    node, err := ParseMessage(strings.NewReader(raw), ParseLimits{SpoolSize: 100, TempDir: dir})
+    if err != nil { t.Fatal(err) }
+
+    // the multipart's own spool is gone once its children are parsed
+    files, _ := ioutil.ReadDir(dir)
+    if len(files) != 2 {
+        t.Errorf("%d temporary files while open, want 2", len(files))
+    }
+
+    if err := node.Close(); err != nil { t.Error(err) }
+    files, _ = ioutil.ReadDir(dir)
+    if len(files) != 0 {
+        t.Errorf("%d temporary files left after Close", len(files))
+    }
+}
+
+func TestParseAttached(t *testing.T) {
+    inner := "From: b@example.com\r\nSubject: inner\r\n" +
+        "Content-Type: multipart/alternative; boundary=i\r\n\r\n" +
+        "--i\r\nContent-Type: text/plain\r\n\r\nplain\r\n" +
+        "--i\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n--i--\r\n"
+    global := "Subject: =?UTF-8?Q?gr=C3=BC=C3=9Fe?=\r\nContent-Type: text/plain; charset=utf-8\r\n\r\ngrüße"
+
+    tests := []struct {
+        name     string
+        part     string
+        // the attached message's subject and text, or "" if it should be
+        // left as a plain part
+        subject  string
+        text     []string
+    }{
+        {"message/rfc822", "Content-Type: message/rfc822\r\n\r\n" + inner, "inner", []string{"plain", "<p>html</p>"}},
+        {"base64 message/global",
+            "Content-Type: message/global\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+                testBase64([]byte(global)),
+            "grüße", []string{"grüße"}},
+        {"not a message", "Content-Type: message/rfc822\r\n\r\nno colon here\r\n\r\nbody", "", nil},
+    }
+
+    for _, test := range tests {
+        raw := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+            "--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+            "--b\r\n" + test.part + "\r\n--b--\r\n"
+        for _, spool := range []int64{1 << 20, 10} {
+            node, err := ParseMessage(strings.NewReader(raw), ParseLimits{SpoolSize: spool})
+            if err != nil || node == nil || len(node.Children) != 2 {
+                t.Errorf("%s (spool %d): %v, %v", test.name, spool, node, err)
+                continue
+            }
+            attached := node.Children[1]
+
+            if test.subject == "" {
+                if attached.Children != nil || attached.Body == nil {
+                    t.Errorf("%s (spool %d): not left as a plain part", test.name, spool)
+                }
+                node.Close()
+                continue
+            }
+
+            if len(attached.Children) != 1 {
+                t.Errorf("%s (spool %d): %d children", test.name, spool, len(attached.Children))
+                node.Close()
+                continue
+            }
+            message := attached.Children[0]
+            if subject := message.Subject(); subject != test.subject {
+                t.Errorf("%s (spool %d): subject %q, want %q", test.name, spool, subject, test.subject)
+            }
+            text := make([]string, 0)
+            message.ForEach(func(part *MessageNode) {
+                if part.Body == nil { return }
+                data, _ := part.Body.Data()
+                text = append(text, string(data))
+            })
+            if strings.Join(text, "|") != strings.Join(test.text, "|") {
+                t.Errorf("%s (spool %d): text %q, want %q", test.name, spool, text, test.text)
+            }
+            node.Close()
+        }
+    }
+}
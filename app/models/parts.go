@@ -0,0 +1,305 @@
+package models
+
+// fetching a message a part at a time. BODYSTRUCTURE gives us the MIME
+// tree up front, so we can show the text of a message without downloading
+// its attachments, and download an attachment without the rest.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "bytes"
+    "fmt"
+    "io"
+    "mime"
+    "net/mail"
+)
+
+// the MIME tree of this message, built from BODYSTRUCTURE. Parts have
+// their Section set, but no Body until it's fetched with FetchPart or
+// LoadText.
+func (m *Email) Structure() (*MessageNode, error) {
+    // already built, or parsed from the whole body
+    if m.Message != nil && (m.Message.Section != "" || m.Message.Children != nil) {
+        return m.Message, nil
+    }
+
+    if m.structure == nil || m.Message == nil {
+        items := []string{"BODYSTRUCTURE"}
+        if m.Message == nil {
+            items = append(items, "BODY.PEEK[HEADER]")
+        }
+        cmd, err := imap.Wait(m.RetrieveRaw(items...))
+        if err != nil { return nil, err }
+        if len(cmd.Data) == 0 {
+            return nil, fmt.Errorf("message %d not found", m.UID)
+        }
+
+        info := cmd.Data[0].MessageInfo()
+        if m.Message == nil {
+            if err := m.setHeader(imap.AsBytes(info.Attrs["BODY[HEADER]"])); err != nil {
+                return nil, err
+            }
+        }
+        if m.structure = parseBodyStructure(info.Attrs["BODYSTRUCTURE"]); m.structure == nil {
+            return nil, fmt.Errorf("could not read the structure of message %d", m.UID)
+        }
+    }
+
+    root := m.structure.node()
+    // the top level has the real message header
+    root.Header = m.Message.Header
+    m.setMessage(root)
+    return root, nil
+}
+
+// a MessageNode skeleton for this part and its children, with a header
+// made up from what BODYSTRUCTURE told us
+func (b *BodyStructure) node() *MessageNode {
+    node := &MessageNode{
+        ContentType: b.MimeType(),
+        ContentTypeParams: b.Params,
+        Header: make(mail.Header),
+        Section: b.Section,
+        Size: b.Size,
+    }
+
+    node.Header["Content-Type"] = []string{mime.FormatMediaType(b.MimeType(), b.Params)}
+    if b.Encoding != "" {
+        node.Header["Content-Transfer-Encoding"] = []string{b.Encoding}
+    }
+    if b.ID != "" {
+        node.Header["Content-Id"] = []string{b.ID}
+    }
+    if b.Description != "" {
+        node.Header["Content-Description"] = []string{b.Description}
+    }
+    if b.Disposition != "" {
+        node.Header["Content-Disposition"] = []string{
+            mime.FormatMediaType(b.Disposition, b.DispositionParams),
+        }
+    }
+
+    node.Filename = node.filename()
+
+    if len(b.Parts) > 0 {
+        node.Children = make([]*MessageNode, len(b.Parts))
+        for i, part := range b.Parts {
+            node.Children[i] = part.node()
+        }
+    }
+    return node
+}
+
+// the FETCH item for a section. The top-level multipart has no number,
+// its content is the message text
+func sectionItem(section string) string {
+    if section == "" {
+        return "TEXT"
+    }
+    return section
+}
+
+// fetch one part of the message (still transfer-encoded), like "1.2".
+// doesn't mark the message \Seen.
+func (m *Email) FetchPart(section string) ([]byte, error) {
+    item := "BODY[" + sectionItem(section) + "]"
+    if data, ok := m.cachedPart(item); ok {
+        return data, nil
+    }
+
+    cmd, err := imap.Wait(m.RetrieveRaw("BODY.PEEK[" + sectionItem(section) + "]"))
+    if err != nil { return nil, err }
+    if len(cmd.Data) == 0 {
+        return nil, fmt.Errorf("message %d not found", m.UID)
+    }
+
+    data := imap.AsBytes(cmd.Data[0].MessageInfo().Attrs[item])
+    m.cachePart(item, data)
+    return data, nil
+}
+
+// fetch `length` bytes of a part, starting at `offset`, for serving big
+// attachments in pieces.
+func (m *Email) FetchPartial(section string, offset, length uint32) ([]byte, error) {
+    // the server answers with BODY[1.2]<offset>
+    item := fmt.Sprintf("BODY[%s]<%d>", sectionItem(section), offset)
+    request := fmt.Sprintf("BODY.PEEK[%s]<%d.%d>", sectionItem(section), offset, length)
+
+    cmd, err := imap.Wait(m.RetrieveRaw(request))
+    if err != nil { return nil, err }
+    if len(cmd.Data) == 0 {
+        return nil, fmt.Errorf("message %d not found", m.UID)
+    }
+
+    return imap.AsBytes(cmd.Data[0].MessageInfo().Attrs[item]), nil
+}
+
+// fetch the bodies of the parts a reader would see: text that isn't an
+// attachment. Everything else is left for FetchPart.
+func (m *Email) LoadText() (*MessageNode, error) {
+    root, err := m.Structure()
+    if err != nil { return nil, err }
+
+    var fetchErr error
+    root.ForEach(func(node *MessageNode) {
+        if fetchErr != nil { return }
+
+        // attached messages are shown like the message itself, so they
+        // need their real headers
+        if IsMessageType(node.ContentType) && len(node.Children) == 1 {
+            fetchErr = m.loadAttachedHeader(node)
+            return
+        }
+
+        if node.Body != nil || node.Children != nil { return }
+        if !IsText(node) || node.IsAttachment() { return }
+
+        data, err := m.FetchPart(node.Section)
+        if err != nil {
+            fetchErr = err
+            return
+        }
+        node.SetBody(data)
+    })
+
+    root.ResolveInline(func(part *MessageNode) string {
+        return m.PartURL(part.Section)
+    })
+    return root, fetchErr
+}
+
+// fetch the header of an attached message, in place of the one we made
+// up from BODYSTRUCTURE
+func (m *Email) loadAttachedHeader(node *MessageNode) error {
+    inner := node.Children[0]
+    if inner.Header.Get("From") != "" || inner.Header.Get("Date") != "" {
+        return nil
+    }
+
+    // the server can't pick the header out of a message/global that's
+    // transfer-encoded, so that one has to come whole and be decoded here
+    var header []byte
+    var err error
+    switch encoding := transferEncoding(node.Header); encoding {
+    case EncodingBase64, EncodingQuotedPrintable:
+        header, err = m.FetchPart(node.Section)
+        if err != nil { return err }
+        header, _ = decodeTransfer(encoding, header)
+    default:
+        header, err = m.FetchPart(node.Section + ".HEADER")
+        if err != nil { return err }
+    }
+    msg, err := mail.ReadMessage(bytes.NewReader(header))
+    if err != nil {
+        // keep the made up one
+        debug("could not read attached message header: ", err)
+        return nil
+    }
+    inner.Header = msg.Header
+    return nil
+}
+
+// how much of a big part PartData fetches at a time
+const partChunkSize = 1 << 20
+
+// a part's decoded content, in memory if it's small and in a temporary
+// file if it isn't. Close it when done.
+type PartContent struct {
+    io.ReadSeeker
+    spool *spool
+}
+
+// delete the temporary file, if there is one
+func (p *PartContent) Close() error { return p.spool.Close() }
+
+// a part of this message by IMAP section number, and its content with
+// the Content-Transfer-Encoding undone. Text is left in its own charset.
+// The content isn't kept on the part, so the message's JSON stays small.
+// The part is decoded as it's spooled. go-imap reads a whole literal into
+// memory, so parts bigger than partChunkSize are fetched a chunk at a time
+// to keep only one chunk of the encoded copy in memory.
+func (m *Email) PartData(section string) (*MessageNode, *PartContent, error) {
+    root, err := m.Structure()
+    if err != nil { return nil, nil, err }
+
+    // attached messages can be downloaded whole
+    part := root.Find(section)
+    if part == nil || (part.Children != nil && !IsMessageType(part.ContentType)) {
+        return nil, nil, fmt.Errorf("message %d has no part %q", m.UID, section)
+    }
+
+    if part.Size > partChunkSize {
+        sp, err := m.spoolChunks(part, true)
+        if err == nil && sp.size == 0 {
+            // couldn't decode any of it; better the raw data than nothing
+            sp.Close()
+            sp, err = m.spoolChunks(part, false)
+        }
+        if err != nil { return nil, nil, err }
+        return part, &PartContent{sp.reader(), sp}, nil
+    }
+
+    data, err := m.FetchPart(section)
+    if err != nil { return nil, nil, err }
+    decoded, _ := decodingReader(transferEncoding(part.Header), bytes.NewReader(data))
+    sp, err := (&parser{DefaultParseLimits}).spool(partialReader{decoded}, 0)
+    if err != nil {
+        if sp != nil { sp.Close() }
+        return nil, nil, err
+    }
+    if sp.size == 0 && len(data) > 0 {
+        // couldn't decode any of it; better the raw data than nothing
+        sp = &spool{mem: data, size: int64(len(data))}
+    }
+    return part, &PartContent{sp.reader(), sp}, nil
+}
+
+// spool a big part straight from the server, decoding it on the way if
+// asked to. Data that stops decoding ends the part, but failing to fetch
+// it is an error.
+func (m *Email) spoolChunks(part *MessageNode, decode bool) (*spool, error) {
+    chunks := &chunkReader{email: m, section: part.Section}
+    var r io.Reader = chunks
+    if decode {
+        r, _ = decodingReader(transferEncoding(part.Header), chunks)
+    }
+    sp, err := (&parser{DefaultParseLimits}).spool(partialReader{r}, 0)
+    if err == nil {
+        err = chunks.err
+    }
+    if err != nil {
+        if sp != nil { sp.Close() }
+        return nil, err
+    }
+    return sp, nil
+}
+
+// reads a part from the server partChunkSize bytes at a time
+type chunkReader struct {
+    email   *Email
+    section string
+    offset  uint32
+    chunk   []byte
+    done    bool
+    // why fetching stopped, if it wasn't the end of the part
+    err     error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+    for len(r.chunk) == 0 {
+        if r.done || r.err != nil { return 0, io.EOF }
+        data, err := r.email.FetchPartial(r.section, r.offset, partChunkSize)
+        if err != nil {
+            // partialReader would take this for the end of the data, so
+            // it's kept for spoolChunks to report
+            r.err = err
+            return 0, err
+        }
+        r.offset += uint32(len(data))
+        // a short chunk is the last one
+        r.done = len(data) < partChunkSize
+        r.chunk = data
+    }
+    n := copy(p, r.chunk)
+    r.chunk = r.chunk[n:]
+    return n, nil
+}
@@ -0,0 +1,246 @@
+package models
+
+import (
+    "bytes"
+    "encoding/base64"
+    "fmt"
+    "io/ioutil"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+const (
+    partsHeader = "From: a@example.com\r\nSubject: outer\r\n\r\n"
+    attachedHeader = "From: b@example.com\r\nSubject: inner\r\n\r\n"
+    plainPart = `("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 5 1)`
+    htmlPart = `("TEXT" "HTML" ("CHARSET" "us-ascii") NIL NIL "7BIT" 5 1)`
+    imagePart = `("IMAGE" "PNG" ("NAME" "a.png") NIL NIL "BASE64" 100)`
+    attachedEnvelope = `(NIL "inner" NIL NIL NIL NIL NIL NIL NIL NIL)`
+)
+
+// a message/rfc822 part with this body
+func attachedPart(body string) string {
+    return `("MESSAGE" "RFC822" NIL NIL NIL "7BIT" 300 ` + attachedEnvelope + " " + body + " 10)"
+}
+
+func TestStructureSections(t *testing.T) {
+    tests := []struct {
+        name      string
+        structure string
+        // every node's section, in tree order
+        sections  []string
+        // the parts LoadText fetches, in order
+        fetched   []string
+    }{
+        {
+            "single part",
+            plainPart,
+            []string{"1"},
+            []string{"1"},
+        },
+        {
+            "nested multipart",
+            "(" + plainPart + "(" + plainPart + htmlPart + ` "ALTERNATIVE") "MIXED")`,
+            []string{"", "1", "2", "2.1", "2.2"},
+            []string{"1", "2.1", "2.2"},
+        },
+        {
+            "attached multipart message",
+            "(" + plainPart + attachedPart("(" + plainPart + imagePart + ` "MIXED")`) + ` "MIXED")`,
+            []string{"", "1", "2", "2", "2.1", "2.2"},
+            []string{"1", "2.HEADER", "2.1"},
+        },
+        {
+            "attached single part message",
+            "(" + plainPart + attachedPart(plainPart) + ` "MIXED")`,
+            []string{"", "1", "2", "2.1"},
+            []string{"1", "2.HEADER", "2.1"},
+        },
+    }
+
+    for _, test := range tests {
+        m, f := newFakeMailbox(t, "", 1, func(command string) string {
+            if strings.Contains(command, "BODYSTRUCTURE") {
+                return fmt.Sprintf("* 1 FETCH (UID 7 BODYSTRUCTURE %s BODY[HEADER] {%d}\r\n%s)\r\n",
+                    test.structure, len(partsHeader), partsHeader)
+            }
+            open := strings.Index(command, "BODY.PEEK[")
+            if open < 0 { return "" }
+            section := command[open + len("BODY.PEEK["):strings.Index(command, "]")]
+            data := "hello"
+            if strings.HasSuffix(section, ".HEADER") {
+                data = attachedHeader
+            }
+            return fmt.Sprintf("* 1 FETCH (UID 7 BODY[%s] {%d}\r\n%s)\r\n", section, len(data), data)
+        })
+        email := &Email{server: m.server, mailbox: m, UID: 7}
+        m.Mail[7] = email
+
+        root, err := email.LoadText()
+        f.Close()
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+
+        sections := make([]string, 0)
+        root.ForEach(func(node *MessageNode) {
+            sections = append(sections, node.Section)
+        })
+        if !reflect.DeepEqual(sections, test.sections) {
+            t.Errorf("%s: sections %q, want %q", test.name, sections, test.sections)
+        }
+        if root.Header.Get("Subject") != "outer" {
+            t.Errorf("%s: top level header %v", test.name, root.Header)
+        }
+
+        fetched := make([]string, 0)
+        for _, command := range f.Commands() {
+            if open := strings.Index(command, "BODY.PEEK["); open >= 0 && !strings.Contains(command, "BODYSTRUCTURE") {
+                fetched = append(fetched, command[open + len("BODY.PEEK["):strings.Index(command, "]")])
+            }
+        }
+        if !reflect.DeepEqual(fetched, test.fetched) {
+            t.Errorf("%s: fetched %q, want %q", test.name, fetched, test.fetched)
+        }
+
+        // attached messages get their real header
+        root.ForEach(func(node *MessageNode) {
+            if IsMessageType(node.ContentType) && node.Children[0].Header.Get("Subject") != "inner" {
+                t.Errorf("%s: attached header %v", test.name, node.Children[0].Header)
+            }
+        })
+    }
+}
+
+func TestLoadAttachedHeader(t *testing.T) {
+    encoded := base64.StdEncoding.EncodeToString([]byte(attachedHeader + "hello"))
+    global := `("MESSAGE" "GLOBAL" NIL NIL NIL "BASE64" 300 ` + attachedEnvelope + " " + plainPart + " 10)"
+    // servers describe an encoded message/global like any other leaf
+    globalLeaf := `("MESSAGE" "GLOBAL" NIL NIL NIL "BASE64" 300 NIL ("ATTACHMENT" ("FILENAME" "fwd.eml")) NIL NIL)`
+
+    tests := []struct {
+        name      string
+        structure string
+        // the section fetched for the attached header, if any
+        fetched   string
+        subject   string
+    }{
+        {"message/rfc822", "(" + plainPart + attachedPart(plainPart) + ` "MIXED")`, "2.HEADER", "inner"},
+        {"base64 message/global", "(" + plainPart + global + ` "MIXED")`, "2", "inner"},
+        {"message/global leaf", "(" + plainPart + globalLeaf + ` "MIXED")`, "", ""},
+    }
+
+    for _, test := range tests {
+        m, f := newFakeMailbox(t, "", 1, func(command string) string {
+            if strings.Contains(command, "BODYSTRUCTURE") {
+                return fmt.Sprintf("* 1 FETCH (UID 7 BODYSTRUCTURE %s BODY[HEADER] {%d}\r\n%s)\r\n",
+                    test.structure, len(partsHeader), partsHeader)
+            }
+            open := strings.Index(command, "BODY.PEEK[")
+            if open < 0 { return "" }
+            section := command[open + len("BODY.PEEK["):strings.Index(command, "]")]
+            data := "hello"
+            switch section {
+            case "2.HEADER":
+                data = attachedHeader
+            case "2":
+                data = encoded
+            }
+            return fmt.Sprintf("* 1 FETCH (UID 7 BODY[%s] {%d}\r\n%s)\r\n", section, len(data), data)
+        })
+        email := &Email{server: m.server, mailbox: m, UID: 7}
+        m.Mail[7] = email
+
+        root, err := email.LoadText()
+        f.Close()
+        if err != nil {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+
+        fetched := ""
+        for _, command := range f.Commands() {
+            if strings.Contains(command, "BODY.PEEK[2") {
+                fetched = command[strings.Index(command, "BODY.PEEK[") + len("BODY.PEEK["):strings.Index(command, "]")]
+                break
+            }
+        }
+        if fetched != test.fetched {
+            t.Errorf("%s: fetched %q, want %q", test.name, fetched, test.fetched)
+        }
+
+        attached := root.Find("2")
+        if test.subject == "" {
+            if attached == nil || attached.Children != nil || !attached.IsAttachment() {
+                t.Errorf("%s: not left as an attachment: %v", test.name, attached)
+            }
+            continue
+        }
+        if attached == nil || len(attached.Children) != 1 {
+            t.Errorf("%s: attached message is %v", test.name, attached)
+        } else if subject := attached.Children[0].Header.Get("Subject"); subject != test.subject {
+            t.Errorf("%s: attached subject %q, want %q", test.name, subject, test.subject)
+        }
+    }
+}
+
+func TestPartDataInChunks(t *testing.T) {
+    data := testData(partChunkSize)
+    encoded := testBase64(data)
+    structure := "(" + plainPart + fmt.Sprintf(`("APPLICATION" "OCTET-STREAM" ("NAME" "a.bin") NIL NIL "BASE64" %d)`, len(encoded)) + ` "MIXED")`
+
+    for _, broken := range []bool{false, true} {
+        m, f := newFakeMailbox(t, "", 1, func(command string) string {
+            if strings.Contains(command, "BODYSTRUCTURE") {
+                return fmt.Sprintf("* 1 FETCH (UID 7 BODYSTRUCTURE %s BODY[HEADER] {%d}\r\n%s)\r\n",
+                    structure, len(partsHeader), partsHeader)
+            }
+            var offset, length int
+            open := strings.Index(command, "BODY.PEEK[2]<")
+            if open < 0 { return "" }
+            fmt.Sscanf(command[open:], "BODY.PEEK[2]<%d.%d>", &offset, &length)
+            // the connection drops after the first chunk
+            if broken && offset > 0 { return "" }
+            chunk := encoded[offset:]
+            if len(chunk) > length {
+                chunk = chunk[:length]
+            }
+            return fmt.Sprintf("* 1 FETCH (UID 7 BODY[2]<%d> {%d}\r\n%s)\r\n", offset, len(chunk), chunk)
+        })
+        email := &Email{server: m.server, mailbox: m, UID: 7}
+        m.Mail[7] = email
+
+        _, content, err := email.PartData("2")
+        f.Close()
+        if broken {
+            if err == nil {
+                content.Close()
+                t.Errorf("broken fetch: no error")
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%v", err)
+            continue
+        }
+        got, err := ioutil.ReadAll(content)
+        content.Close()
+        if err != nil || !bytes.Equal(got, data) {
+            t.Errorf("got %d bytes (%v), want %d", len(got), err, len(data))
+        }
+
+        chunks := 0
+        for _, command := range f.Commands() {
+            if strings.Contains(command, "BODY.PEEK[2]<") {
+                chunks++
+            } else if strings.Contains(command, "BODY.PEEK[2]") {
+                t.Errorf("fetched the whole part: %q", command)
+            }
+        }
+        if want := (len(encoded) + partChunkSize - 1) / partChunkSize; chunks != want {
+            t.Errorf("fetched %d chunks, want %d", chunks, want)
+        }
+    }
+}
@@ -0,0 +1,185 @@
+package models
+
+// whitelist-based cleaning of HTML mail, so it can be shown in the web UI
+// without running anybody's scripts. Anything not explicitly allowed is
+// dropped: unknown tags lose their markup but keep their text, and a few
+// (scripts, forms controls, frames...) are removed with everything in them.
+
+import (
+    "bytes"
+    "io"
+    "regexp"
+    "strings"
+
+    "golang.org/x/net/html"
+    "golang.org/x/net/html/atom"
+)
+
+// MIME type of HTML parts
+const TypeHTML = "text/html"
+
+// tags we keep
+var allowedTags = map[atom.Atom]bool{
+    atom.A: true, atom.Abbr: true, atom.Address: true, atom.B: true,
+    atom.Bdo: true, atom.Big: true, atom.Blockquote: true, atom.Br: true,
+    atom.Caption: true, atom.Center: true, atom.Cite: true, atom.Code: true,
+    atom.Col: true, atom.Colgroup: true, atom.Dd: true, atom.Del: true,
+    atom.Dfn: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+    atom.Em: true, atom.Font: true, atom.H1: true, atom.H2: true,
+    atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+    atom.Hr: true, atom.I: true, atom.Img: true, atom.Ins: true,
+    atom.Kbd: true, atom.Li: true, atom.Ol: true, atom.P: true,
+    atom.Pre: true, atom.Q: true, atom.S: true, atom.Samp: true,
+    atom.Small: true, atom.Span: true, atom.Strike: true, atom.Strong: true,
+    atom.Sub: true, atom.Sup: true, atom.Table: true, atom.Tbody: true,
+    atom.Td: true, atom.Tfoot: true, atom.Th: true, atom.Thead: true,
+    atom.Tr: true, atom.Tt: true, atom.U: true, atom.Ul: true,
+    atom.Var: true,
+}
+
+// tags dropped along with everything inside them
+var droppedTags = map[atom.Atom]bool{
+    atom.Script: true, atom.Style: true, atom.Head: true, atom.Title: true,
+    atom.Iframe: true, atom.Frame: true, atom.Frameset: true,
+    atom.Object: true, atom.Embed: true, atom.Applet: true,
+    atom.Noscript: true, atom.Template: true, atom.Svg: true,
+    atom.Math: true, atom.Select: true, atom.Textarea: true,
+    atom.Button: true, atom.Input: true, atom.Option: true,
+}
+
+// attributes we keep on any allowed tag. URLs and styles are checked
+// separately.
+var allowedAttrs = map[string]bool{
+    "align": true, "alt": true, "bgcolor": true, "border": true,
+    "cellpadding": true, "cellspacing": true, "color": true, "colspan": true,
+    "dir": true, "face": true, "height": true, "lang": true,
+    "rowspan": true, "size": true, "span": true, "start": true,
+    "summary": true, "title": true, "type": true, "valign": true,
+    "width": true,
+}
+
+// CSS properties we keep in style attributes. Entries ending in "-" allow
+// any property starting with them.
+var allowedCSS = []string{
+    "background-color", "border", "border-", "color", "direction",
+    "display", "font", "font-", "height", "letter-spacing", "line-height",
+    "list-style-type", "margin", "margin-", "max-width", "min-width",
+    "padding", "padding-", "text-", "vertical-align", "white-space",
+    "width", "word-spacing",
+}
+
+// things that have no business in a CSS value
+var dangerousCSS = regexp.MustCompile(`(?i)expression|url\s*\(|javascript|vbscript|behavior|binding|@import|[\\<>]`)
+
+// URL schemes allowed in links, and in images
+var linkSchemes = regexp.MustCompile(`(?i)^(https?|mailto):`)
+var imageSchemes = regexp.MustCompile(`(?i)^(https?:|cid:|data:image/(png|gif|jpe?g|webp);)`)
+
+// clean HTML for display. The result is a fragment, not a document. The
+// HTML is parsed the way a browser would, optional end tags and all, so
+// what's dropped is exactly what a browser would have put inside the
+// dropped tags. Input that stops being readable part way is cleaned up to
+// that point.
+func SanitizeHTML(r io.Reader) string {
+    doc, err := html.Parse(partialReader{r})
+    if err != nil { return "" }
+
+    var out bytes.Buffer
+    sanitizeNode(&out, doc)
+    return out.String()
+}
+
+// write the clean version of a node and its children
+func sanitizeNode(out *bytes.Buffer, n *html.Node) {
+    switch n.Type {
+    case html.TextNode:
+        out.WriteString(html.EscapeString(n.Data))
+
+    case html.ElementNode:
+        if droppedTags[n.DataAtom] || n.Namespace != "" { return }
+        if !allowedTags[n.DataAtom] {
+            // the markup goes, the text stays
+            sanitizeChildren(out, n)
+            return
+        }
+        out.WriteString(html.Token{
+            Type: html.StartTagToken,
+            DataAtom: n.DataAtom,
+            Data: n.Data,
+            Attr: sanitizeAttrs(n.DataAtom, n.Attr),
+        }.String())
+        if voidTag(n.DataAtom) { return }
+        sanitizeChildren(out, n)
+        out.WriteString("</" + n.Data + ">")
+
+    case html.DocumentNode:
+        sanitizeChildren(out, n)
+
+    // comments (conditional comments!) and doctypes are dropped
+    }
+}
+
+func sanitizeChildren(out *bytes.Buffer, n *html.Node) {
+    for child := n.FirstChild; child != nil; child = child.NextSibling {
+        sanitizeNode(out, child)
+    }
+}
+
+// allowed tags that never have content or an end tag
+func voidTag(a atom.Atom) bool {
+    return a == atom.Br || a == atom.Hr || a == atom.Img || a == atom.Col
+}
+
+// keep only the attributes we trust, and make links open safely
+func sanitizeAttrs(tag atom.Atom, attrs []html.Attribute) []html.Attribute {
+    clean := make([]html.Attribute, 0, len(attrs))
+    link := false
+    for _, attr := range attrs {
+        if attr.Namespace != "" { continue }
+        key := strings.ToLower(attr.Key)
+        value := strings.TrimSpace(attr.Val)
+
+        switch {
+        case key == "href" && tag == atom.A:
+            if !linkSchemes.MatchString(value) { continue }
+            link = true
+        case key == "src" && tag == atom.Img:
+            if !imageSchemes.MatchString(value) { continue }
+        case key == "style":
+            value = sanitizeCSS(value)
+            if value == "" { continue }
+        case !allowedAttrs[key]:
+            continue
+        }
+        clean = append(clean, html.Attribute{Key: key, Val: value})
+    }
+
+    if link {
+        clean = append(clean,
+            html.Attribute{Key: "target", Val: "_blank"},
+            html.Attribute{Key: "rel", Val: "noopener noreferrer nofollow"},
+        )
+    }
+    return clean
+}
+
+// keep only the declarations in a style attribute we trust
+func sanitizeCSS(style string) string {
+    clean := make([]string, 0)
+    for _, decl := range strings.Split(style, ";") {
+        colon := strings.Index(decl, ":")
+        if colon < 0 { continue }
+        property := strings.ToLower(strings.TrimSpace(decl[:colon]))
+        value := strings.TrimSpace(decl[colon + 1:])
+        if value == "" || dangerousCSS.MatchString(value) { continue }
+
+        for _, allowed := range allowedCSS {
+            if property == allowed ||
+                (strings.HasSuffix(allowed, "-") && strings.HasPrefix(property, allowed)) {
+                clean = append(clean, property + ": " + value)
+                break
+            }
+        }
+    }
+    return strings.Join(clean, "; ")
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+    tests := []struct {
+        name string
+        in   string
+        want string
+    }{
+        {"head closed by body",
+            `<html><head><meta charset=utf-8><body><p>Hello there</p>`,
+            `<p>Hello there</p>`},
+        {"head closed by text",
+            `<html><head><title>t</title>Hello`,
+            `Hello`},
+        {"option closed by p",
+            `<p>Pick: <option>one<p>Important text after</p>`,
+            `<p>Pick: </p><p>Important text after</p>`},
+        {"select and its options",
+            `<select><option>a<option>b</select>after`,
+            `after`},
+        {"script",
+            `<p>a<script>alert(1)</script>b</p>`,
+            `<p>ab</p>`},
+        {"script that never ends",
+            `<p>a</p><script>alert(1)`,
+            `<p>a</p>`},
+        {"unknown tags keep their text",
+            `<blink>hi</blink> <form>there</form>`,
+            `hi there`},
+        {"unclosed tags are closed",
+            `<b>bold<i>both`,
+            `<b>bold<i>both</i></b>`},
+        {"implied table parts",
+            `<table><tr><td>x</table>`,
+            `<table><tbody><tr><td>x</td></tr></tbody></table>`},
+        {"comments",
+            `a<!--[if mso]><b>outlook</b><![endif]-->b`,
+            `ab`},
+        {"svg",
+            `<svg><script>alert(1)</script><text>x</text></svg>y`,
+            `y`},
+        {"event handlers",
+            `<img src="https://example.com/a.png" onerror="alert(1)">`,
+            `<img src="https://example.com/a.png">`},
+        {"image sources",
+            `<img src="javascript:alert(1)" alt="a">`,
+            `<img alt="a">`},
+        {"safe link",
+            `<a href="https://example.com/">x</a>`,
+            `<a href="https://example.com/" target="_blank" rel="noopener noreferrer nofollow">x</a>`},
+        {"unsafe link",
+            `<a href=" javascript:alert(1)">x</a>`,
+            `<a>x</a>`},
+        {"link without href",
+            `<a name="top">x</a>`,
+            `<a>x</a>`},
+        {"styles",
+            `<span style="color: red; background: url(x); position: fixed">x</span>`,
+            `<span style="color: red">x</span>`},
+        {"text is escaped",
+            `&lt;script&gt; &amp; <b>"quotes"</b>`,
+            `&lt;script&gt; &amp; <b>&#34;quotes&#34;</b>`},
+    }
+
+    for _, test := range tests {
+        if got := SanitizeHTML(strings.NewReader(test.in)); got != test.want {
+            t.Errorf("%s: SanitizeHTML(%q)\n  got  %q\n  want %q", test.name, test.in, got, test.want)
+        }
+    }
+}
@@ -0,0 +1,341 @@
+package models
+
+// server-side IMAP SEARCH, so finding a message doesn't mean downloading
+// every header in the mailbox.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// IMAP dates in SEARCH have no time or zone
+const searchDate = "2-Jan-2006"
+
+// search keys for flags that have their own keyword.
+// the first is the key when set, the second when unset
+var flagSearchKeys = map[string][2]string{
+    FlagSeen:     {"SEEN", "UNSEEN"},
+    FlagAnswered: {"ANSWERED", "UNANSWERED"},
+    FlagFlagged:  {"FLAGGED", "UNFLAGGED"},
+    FlagDeleted:  {"DELETED", "UNDELETED"},
+    FlagDraft:    {"DRAFT", "UNDRAFT"},
+    `\Recent`:    {"RECENT", "OLD"},
+}
+
+// one search key, rendered once we have a client to quote strings with
+type searchKey func(c *imap.Client) []imap.Field
+
+// A list of search keys. A message has to match all of them.
+// Build one by chaining:
+//
+//     NewCriteria().From("vinod").Since(lastWeek).Flag(FlagSeen)
+//
+type Criteria struct {
+    keys []searchKey
+    // the first bad argument we were given. Criteria with an error can't
+    // be searched with
+    err  error
+}
+
+// an empty set of criteria, matching every message
+func NewCriteria() *Criteria {
+    return &Criteria{}
+}
+
+// add a key made of atoms
+func (cr *Criteria) atoms(fields ...imap.Field) *Criteria {
+    cr.keys = append(cr.keys, func(c *imap.Client) []imap.Field {
+        return fields
+    })
+    return cr
+}
+
+// add a key followed by a string argument, which may need quoting
+func (cr *Criteria) text(key string, args ...string) *Criteria {
+    cr.keys = append(cr.keys, func(c *imap.Client) []imap.Field {
+        fields := []imap.Field{key}
+        for _, arg := range args {
+            fields = append(fields, c.Quote(arg))
+        }
+        return fields
+    })
+    return cr
+}
+
+// messages with `s` in the From header
+func (cr *Criteria) From(s string) *Criteria { return cr.text("FROM", s) }
+// messages with `s` in the To header
+func (cr *Criteria) To(s string) *Criteria { return cr.text("TO", s) }
+// messages with `s` in the Cc header
+func (cr *Criteria) Cc(s string) *Criteria { return cr.text("CC", s) }
+// messages with `s` in the Bcc header
+func (cr *Criteria) Bcc(s string) *Criteria { return cr.text("BCC", s) }
+// messages with `s` in the Subject header
+func (cr *Criteria) Subject(s string) *Criteria { return cr.text("SUBJECT", s) }
+// messages with `s` in the body
+func (cr *Criteria) Body(s string) *Criteria { return cr.text("BODY", s) }
+// messages with `s` anywhere in the headers or body
+func (cr *Criteria) Text(s string) *Criteria { return cr.text("TEXT", s) }
+// messages with `value` in the header named `name`. an empty value
+// matches every message that has the header
+func (cr *Criteria) Header(name, value string) *Criteria {
+    return cr.text("HEADER", name, value)
+}
+
+// messages that arrived on or after the given day
+func (cr *Criteria) Since(t time.Time) *Criteria {
+    return cr.atoms("SINCE", t.Format(searchDate))
+}
+// messages that arrived before the given day
+func (cr *Criteria) Before(t time.Time) *Criteria {
+    return cr.atoms("BEFORE", t.Format(searchDate))
+}
+// messages that arrived on the given day
+func (cr *Criteria) On(t time.Time) *Criteria {
+    return cr.atoms("ON", t.Format(searchDate))
+}
+// messages whose Date header is on or after the given day
+func (cr *Criteria) SentSince(t time.Time) *Criteria {
+    return cr.atoms("SENTSINCE", t.Format(searchDate))
+}
+// messages whose Date header is before the given day
+func (cr *Criteria) SentBefore(t time.Time) *Criteria {
+    return cr.atoms("SENTBEFORE", t.Format(searchDate))
+}
+
+// messages with a flag or keyword set. Anything but a system flag or a
+// valid keyword atom makes the criteria an error; see Err
+func (cr *Criteria) Flag(flag string) *Criteria {
+    if keys, ok := flagSearchKeys[flag]; ok {
+        return cr.atoms(keys[0])
+    }
+    if err := checkKeyword(flag); err != nil {
+        return cr.fail(err)
+    }
+    return cr.atoms("KEYWORD", flag)
+}
+// messages without a flag or keyword set. See Flag
+func (cr *Criteria) NoFlag(flag string) *Criteria {
+    if keys, ok := flagSearchKeys[flag]; ok {
+        return cr.atoms(keys[1])
+    }
+    if err := checkKeyword(flag); err != nil {
+        return cr.fail(err)
+    }
+    return cr.atoms("UNKEYWORD", flag)
+}
+
+// keywords go to the server as bare atoms, so anything else in one would
+// end up in the command itself
+func checkKeyword(keyword string) error {
+    if err := checkFlags([]string{keyword}); err != nil { return err }
+    // only system flags start with a backslash, and we know those
+    if strings.HasPrefix(keyword, `\`) {
+        return fmt.Errorf("unknown system flag %q", keyword)
+    }
+    return nil
+}
+
+// remember the first error building the criteria
+func (cr *Criteria) fail(err error) *Criteria {
+    if cr.err == nil {
+        cr.err = err
+    }
+    return cr
+}
+
+// the first invalid argument given while building these criteria, or nil
+func (cr *Criteria) Err() error {
+    if cr == nil { return nil }
+    return cr.err
+}
+
+// messages bigger than n bytes
+func (cr *Criteria) Larger(n uint32) *Criteria { return cr.atoms("LARGER", n) }
+// messages smaller than n bytes
+func (cr *Criteria) Smaller(n uint32) *Criteria { return cr.atoms("SMALLER", n) }
+
+// messages with one of the given UIDs
+func (cr *Criteria) UIDs(uids ...uint32) *Criteria {
+    set := &imap.SeqSet{}
+    set.AddNum(uids...)
+    return cr.atoms("UID", set)
+}
+
+// messages matching either a or b
+func (cr *Criteria) Or(a, b *Criteria) *Criteria {
+    if err := a.Err(); err != nil {
+        cr.fail(err)
+    }
+    if err := b.Err(); err != nil {
+        cr.fail(err)
+    }
+    cr.keys = append(cr.keys, func(c *imap.Client) []imap.Field {
+        return []imap.Field{"OR", a.group(c), b.group(c)}
+    })
+    return cr
+}
+
+// messages not matching a
+func (cr *Criteria) Not(a *Criteria) *Criteria {
+    if err := a.Err(); err != nil {
+        cr.fail(err)
+    }
+    cr.keys = append(cr.keys, func(c *imap.Client) []imap.Field {
+        return []imap.Field{"NOT", a.group(c)}
+    })
+    return cr
+}
+
+// the search keys to send to the server
+func (cr *Criteria) fields(c *imap.Client) []imap.Field {
+    if cr == nil || len(cr.keys) == 0 {
+        return []imap.Field{"ALL"}
+    }
+    fields := make([]imap.Field, 0, len(cr.keys) * 2)
+    for _, key := range cr.keys {
+        fields = append(fields, key(c)...)
+    }
+    return fields
+}
+
+// the criteria as a single parenthesized search key, for OR and NOT
+func (cr *Criteria) group(c *imap.Client) imap.Field {
+    return cr.fields(c)
+}
+
+// what a search found
+type SearchResult struct {
+    // every matching UID, lowest first
+    UIDs  []uint32
+    Count uint32
+    // lowest and highest matching UID. 0 if nothing matched
+    Min   uint32
+    Max   uint32
+}
+
+// run a UID SEARCH on the server.
+// uses ESEARCH (RFC 4731) when the server has it, which gets us the count
+// and the UIDs as compact ranges instead of one number per message.
+func (m *Mailbox) Search(criteria *Criteria) (*SearchResult, error) {
+    if err := criteria.Err(); err != nil { return nil, err }
+    c, err := m.open(true)
+    if err != nil { return nil, err }
+
+    if c.Caps["ESEARCH"] {
+        return m.esearch(c, criteria, "MIN", "MAX", "COUNT", "ALL")
+    }
+
+    cmd, err := imap.Wait(c.UIDSearch(criteria.fields(c)...))
+    if err != nil { return nil, err }
+
+    result := &SearchResult{UIDs: make([]uint32, 0)}
+    for _, rsp := range cmd.Data {
+        result.UIDs = append(result.UIDs, rsp.SearchResults()...)
+    }
+    sort.Sort(uidSlice(result.UIDs))
+
+    result.Count = uint32(len(result.UIDs))
+    if result.Count > 0 {
+        result.Min = result.UIDs[0]
+        result.Max = result.UIDs[result.Count - 1]
+    }
+    return result, nil
+}
+
+// UID SEARCH RETURN (...) and parse the ESEARCH response, which looks like
+//
+//     * ESEARCH (TAG "A282") UID MIN 2 MAX 11 COUNT 3 ALL 2,10:11
+//
+func (m *Mailbox) esearch(c *imap.Client, criteria *Criteria, returns ...imap.Field) (*SearchResult, error) {
+    args := []imap.Field{
+        "RETURN", returns,
+        "CHARSET", "UTF-8",
+    }
+    cmd, err := imap.Wait(c.Send("UID SEARCH", append(args, criteria.fields(c)...)...))
+    if err != nil { return nil, err }
+
+    result := &SearchResult{UIDs: make([]uint32, 0)}
+    for _, rsp := range cmd.Data {
+        if rsp.Label != "ESEARCH" { continue }
+
+        fields := rsp.Fields[1:]
+        for i := 0; i < len(fields); i++ {
+            // skip the (TAG "...") correlator and the UID indicator
+            if imap.TypeOf(fields[i]) == imap.List { continue }
+            name := strings.ToUpper(imap.AsAtom(fields[i]))
+            if name == "UID" || i + 1 >= len(fields) { continue }
+
+            value := fields[i + 1]
+            i++
+            switch name {
+            case "MIN":
+                result.Min = imap.AsNumber(value)
+            case "MAX":
+                result.Max = imap.AsNumber(value)
+            case "COUNT":
+                result.Count = imap.AsNumber(value)
+            case "ALL":
+                uids, err := expandSet(fmt.Sprint(value))
+                if err != nil { return nil, err }
+                result.UIDs = uids
+            }
+        }
+    }
+    return result, nil
+}
+
+// expand a sequence set string like "2,10:11" into its numbers.
+// "*" isn't allowed; servers never send it in results
+func expandSet(set string) ([]uint32, error) {
+    nums := make([]uint32, 0)
+    if set == "" { return nums, nil }
+
+    for _, part := range strings.Split(set, ",") {
+        bounds := strings.SplitN(part, ":", 2)
+        lo, err := strconv.ParseUint(bounds[0], 10, 32)
+        if err != nil { return nil, fmt.Errorf("bad sequence set %q", set) }
+        hi := lo
+        if len(bounds) == 2 {
+            hi, err = strconv.ParseUint(bounds[1], 10, 32)
+            if err != nil { return nil, fmt.Errorf("bad sequence set %q", set) }
+        }
+        if lo > hi {
+            lo, hi = hi, lo
+        }
+        for n := lo; n <= hi; n++ {
+            nums = append(nums, uint32(n))
+        }
+    }
+    return nums, nil
+}
+
+// get the messages for a list of UIDs, in the same order, fetching headers
+// for any we don't have cached. UIDs that don't exist are left out.
+func (m *Mailbox) Emails(uids []uint32) ([]*Email, error) {
+    missing := &imap.SeqSet{}
+    for _, uid := range uids {
+        if _, ok := m.Mail[uid]; !ok {
+            missing.AddNum(uid)
+        }
+    }
+
+    if !missing.Empty() {
+        c, err := m.open(true)
+        if err != nil { return nil, err }
+        m.generation++
+        if _, err := m.backfill(c, missing); err != nil { return nil, err }
+    }
+
+    emails := make([]*Email, 0, len(uids))
+    for _, uid := range uids {
+        if email, ok := m.Mail[uid]; ok {
+            emails = append(emails, email)
+        }
+    }
+    return emails, nil
+}
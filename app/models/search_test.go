@@ -0,0 +1,38 @@
+package models
+
+import (
+    "testing"
+)
+
+func TestFlagRejectsBadKeywords(t *testing.T) {
+    bad := []string{
+        "x\r\nA1 DELETE INBOX",
+        "two words",
+        "(paren",
+        `"quoted"`,
+        `\Bogus`,
+        "",
+    }
+    for _, keyword := range bad {
+        if NewCriteria().Flag(keyword).Err() == nil {
+            t.Errorf("Flag(%q) was accepted", keyword)
+        }
+        if NewCriteria().NoFlag(keyword).Err() == nil {
+            t.Errorf("NoFlag(%q) was accepted", keyword)
+        }
+    }
+
+    good := []string{"$Forwarded", "Junk", FlagSeen, `\Recent`}
+    for _, keyword := range good {
+        if err := NewCriteria().Flag(keyword).Err(); err != nil {
+            t.Errorf("Flag(%q): %v", keyword, err)
+        }
+    }
+}
+
+func TestOrKeepsErrors(t *testing.T) {
+    criteria := NewCriteria().Or(NewCriteria().From("a"), NewCriteria().Flag("bad keyword"))
+    if criteria.Err() == nil {
+        t.Error("Or lost the error from its argument")
+    }
+}
@@ -9,6 +9,8 @@ import (
     "log"
     "crypto/tls"
     "fmt"
+    "net"
+    "strings"
 )
 
 ///////// server ///////////
@@ -31,6 +33,15 @@ type Server struct {
     client *imap.Client
     disconnectTimer *time.Timer
 
+    // nil unless tracing was turned on with EnableTrace
+    Trace *ProtocolTrace
+    // extensions ENABLEd on the current connection
+    enabled map[string]bool
+    // special-use attribute (\Trash, \Archive...) -> mailbox name
+    special map[string]string
+    // undo token -> how to undo a delete
+    undo    map[string]*undoEntry
+
     Mailboxes map[string]*Mailbox
 }
 
@@ -45,6 +56,31 @@ func NewServer(hostname, username, password string) *Server {
     return server
 }
 
+// start recording the IMAP conversation with this server.
+// takes effect on the next connection; we reconnect if we're already
+// connected so the trace starts from the beginning of a session.
+func (s *Server) EnableTrace() {
+    if s.Trace != nil { return }
+    s.Trace = NewProtocolTrace()
+    s.Close()
+}
+
+// stop recording and throw away the transcript
+func (s *Server) DisableTrace() {
+    if s.client != nil {
+        s.client.SetLogMask(imap.LogNone)
+    }
+    s.Trace = nil
+}
+
+// log a message about this server, and put it in the trace if we have one
+func (s *Server) logf(format string, args ...interface{}) {
+    log.Printf("%s: " + format, append([]interface{}{s.Hostname}, args...)...)
+    if s.Trace != nil {
+        s.Trace.Note(format, args...)
+    }
+}
+
 // use whatever imap connection type is specified by s.UseTLS
 func (s *Server) Connect() (*imap.Client, error) {
     if s.client != nil {
@@ -75,6 +111,11 @@ func (s *Server) Connect() (*imap.Client, error) {
         return nil, fmt.Errorf("expected imap.Login state, instead was %v.", c.State())
     }
 
+    if err := s.enableExtensions(c); err != nil {
+        s.Close()
+        return nil, err
+    }
+
     // auto-disconnect after a certain timeout
     s.disconnectTimer = time.AfterFunc(NoUsageDisconnect, func () {
         s.Close()
@@ -85,25 +126,15 @@ func (s *Server) Connect() (*imap.Client, error) {
 
 // esablish an IMAP connection over TLS
 func (s *Server) dialTLS() (*imap.Client, error) {
-    // establish new connection
-    c, err := imap.DialTLS(s.Hostname, TLSConfig)
-    if err != nil { return nil, err }
-
-    s.client = c
-
-    return c, nil
+    return s.newClient(true)
 }
 
-
-
 // esablish an IMAP connection and upgrade to TLS if possible via STARTTLS
 func (s *Server) dial() (*imap.Client, error) {
     // establish new connection
-    c, err := imap.Dial(s.Hostname)
+    c, err := s.newClient(false)
     if err != nil { return nil, err }
 
-    s.client = c
-
     // enable encryption if supported
     if c.Caps["STARTTLS"] {
         _, err := c.StartTLS(nil)
@@ -112,7 +143,7 @@ func (s *Server) dial() (*imap.Client, error) {
             return nil, err
         }
     } else {
-        log.Printf("Connection %v: TLS DISABLED\n", c)
+        s.logf("TLS DISABLED")
     }
 
     return c, nil
@@ -148,11 +179,157 @@ func (s *Server) GetMailboxes() (boxes []*Mailbox, err error) {
 
     for i, rsp := range cmd.Data {
         info := rsp.MailboxInfo()
-        mbox := NewMailbox(info.Name, s)
-        boxes[i] = mbox
-        s.Mailboxes[mbox.Name] = mbox
+        boxes[i] = s.Mailbox(info.Name)
     }
 
     return boxes, nil
 }
 
+// get every mailbox on the server that can hold messages, including ones
+// nested inside others
+func (s *Server) AllMailboxes() ([]*Mailbox, error) {
+    c, err := s.Connect()
+    if err != nil { return nil, err }
+
+    cmd, err := imap.Wait(c.List("", "*"))
+    if err != nil { return nil, err }
+
+    boxes := make([]*Mailbox, 0, len(cmd.Data))
+    for _, rsp := range cmd.Data {
+        info := rsp.MailboxInfo()
+        selectable := true
+        for attr := range info.Attrs {
+            if strings.EqualFold(attr, `\Noselect`) || strings.EqualFold(attr, `\NonExistent`) {
+                selectable = false
+            }
+        }
+        if selectable {
+            boxes = append(boxes, s.Mailbox(info.Name))
+        }
+    }
+    return boxes, nil
+}
+
+// special-use mailbox attributes (RFC 6154)
+const (
+    SpecialAll     = `\All`
+    SpecialArchive = `\Archive`
+    SpecialDrafts  = `\Drafts`
+    SpecialFlagged = `\Flagged`
+    SpecialJunk    = `\Junk`
+    SpecialSent    = `\Sent`
+    SpecialTrash   = `\Trash`
+)
+
+// names to try when the server doesn't mark its special mailboxes
+var specialNames = map[string][]string{
+    SpecialArchive: {"Archive", "Archives"},
+    SpecialDrafts:  {"Drafts"},
+    SpecialJunk:    {"Junk", "Spam"},
+    SpecialSent:    {"Sent", "Sent Messages", "Sent Items"},
+    SpecialTrash:   {"Trash", "Deleted Messages", "Deleted Items"},
+}
+
+// find the mailbox with a special-use attribute like SpecialTrash.
+// returns nil if the server doesn't have one.
+func (s *Server) SpecialMailbox(attr string) (*Mailbox, error) {
+    if s.special == nil {
+        c, err := s.Connect()
+        if err != nil { return nil, err }
+
+        cmd, err := imap.Wait(c.List("", "*"))
+        if err != nil { return nil, err }
+
+        special := make(map[string]string)
+        names := make(map[string]bool)
+        for _, rsp := range cmd.Data {
+            info := rsp.MailboxInfo()
+            names[info.Name] = true
+            for flag := range info.Attrs {
+                if _, ok := special[flag]; !ok {
+                    special[flag] = info.Name
+                }
+            }
+        }
+
+        // fall back on the usual names
+        for flag, guesses := range specialNames {
+            if _, ok := special[flag]; ok { continue }
+            for _, name := range guesses {
+                if names[name] {
+                    special[flag] = name
+                    break
+                }
+            }
+        }
+        s.special = special
+    }
+
+    name, ok := s.special[attr]
+    if !ok { return nil, nil }
+    return s.Mailbox(name), nil
+}
+
+// get the Mailbox model for a mailbox name, creating it if we haven't
+// seen it before. Reusing the model keeps its message cache around.
+func (s *Server) Mailbox(name string) *Mailbox {
+    if mbox, ok := s.Mailboxes[name]; ok {
+        return mbox
+    }
+    mbox := NewMailbox(name, s)
+    s.Mailboxes[name] = mbox
+    return mbox
+}
+
+// how long to wait for the TCP connection, and then for the greeting.
+// the same as go-imap's Dial
+const (
+    dialTimeout     = 30 * time.Second
+    greetingTimeout = 60 * time.Second
+)
+
+// connect to the server, over TLS if useTLS, and start a client. This is
+// what imap.Dial and imap.DialTLS do, except that the trace is hooked up
+// before the client reads the server's greeting. They return with the
+// greeting already read, which is too late to record it.
+func (s *Server) newClient(useTLS bool) (*imap.Client, error) {
+    addr, port := s.Hostname, "143"
+    if useTLS {
+        port = "993"
+    }
+    if _, _, err := net.SplitHostPort(addr); err != nil {
+        addr = net.JoinHostPort(addr, port)
+    }
+    host, _, _ := net.SplitHostPort(addr)
+
+    conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+    if err != nil { return nil, err }
+    if useTLS {
+        config := TLSConfig.Clone()
+        if config.ServerName == "" {
+            config.ServerName = host
+        }
+        conn = tls.Client(conn, config)
+    }
+
+    var traced *traceConn
+    if s.Trace != nil {
+        s.Trace.Note("connecting to %s", addr)
+        traced = s.Trace.wrap(conn)
+        conn = traced
+    }
+    c, err := imap.NewClient(conn, host, greetingTimeout)
+    if traced != nil {
+        traced.stop()
+    }
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    s.client = c
+    if s.Trace != nil {
+        s.Trace.Attach(c)
+    }
+    return c, nil
+}
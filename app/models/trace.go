@@ -0,0 +1,173 @@
+package models
+
+// opt-in recording of the raw IMAP conversation with a server, for when
+// Mailbox.Update does something weird and we need to see the wire.
+
+import (
+    "code.google.com/p/go-imap/go1/imap"
+    "bytes"
+    "fmt"
+    "log"
+    "net"
+    "regexp"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// number of transcript lines kept per server before the oldest fall off
+const TraceLines = 2000
+
+// what we write instead of secrets
+const traceRedacted = "<redacted>"
+
+// matches the client side of a command that carries credentials: LOGIN,
+// or AUTHENTICATE and its mechanism, so we can hide the arguments.
+// go-imap logs raw lines as "C: <tag> LOGIN ...". Anything after the
+// AUTHENTICATE mechanism is a SASL initial response.
+var traceSecret = regexp.MustCompile(`(?i)^C: (\S+) (LOGIN|AUTHENTICATE \S+)( .*)?$`)
+
+// A ring buffer of IMAP protocol lines. ProtocolTrace implements io.Writer
+// so it can be handed to an imap.Client as its debug logger; each write is
+// one line of the transcript.
+type ProtocolTrace struct {
+    lock  sync.Mutex
+    lines []string
+    next  int
+    full  bool
+
+    // the tag of a LOGIN or AUTHENTICATE that hasn't completed yet. Every
+    // client line until its tagged completion is secret: the rest of a
+    // password sent as a literal, or a SASL response.
+    secretTag string
+}
+
+// create an empty trace that remembers the last TraceLines lines
+func NewProtocolTrace() *ProtocolTrace {
+    return &ProtocolTrace{
+        lines: make([]string, TraceLines),
+    }
+}
+
+// start recording everything a client sends and receives.
+// literals (message bodies) are summarized by go-imap as byte counts, so a
+// big FETCH doesn't wipe out the buffer.
+func (t *ProtocolTrace) Attach(c *imap.Client) {
+    c.SetLogger(log.New(t, "", 0))
+    c.SetLogMask(imap.LogConn | imap.LogRaw)
+}
+
+// add a line of our own to the transcript
+func (t *ProtocolTrace) Note(format string, args ...interface{}) {
+    t.Write([]byte("-- " + fmt.Sprintf(format, args...)))
+}
+
+// implement io.Writer. Each write is redacted and stored as one line.
+func (t *ProtocolTrace) Write(p []byte) (int, error) {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+        line = t.redact(line)
+        t.lines[t.next] = time.Now().Format("15:04:05.000 ") + line
+        t.next = (t.next + 1) % len(t.lines)
+        if t.next == 0 {
+            t.full = true
+        }
+    }
+
+    return len(p), nil
+}
+
+// hide LOGIN passwords and SASL exchanges.
+// must be called with the lock held.
+func (t *ProtocolTrace) redact(line string) string {
+    if m := traceSecret.FindStringSubmatch(line); m != nil {
+        t.secretTag = m[1]
+        if m[3] == "" { return line }
+        return "C: " + m[1] + " " + m[2] + " " + traceRedacted
+    }
+
+    if t.secretTag != "" {
+        if strings.HasPrefix(line, "C: ") {
+            return "C: " + traceRedacted
+        }
+        if strings.HasPrefix(line, "S: " + t.secretTag + " ") {
+            t.secretTag = ""
+        }
+    }
+
+    return line
+}
+
+// the transcript so far, oldest line first
+func (t *ProtocolTrace) Lines() []string {
+    t.lock.Lock()
+    defer t.lock.Unlock()
+
+    if !t.full {
+        return append([]string(nil), t.lines[:t.next]...)
+    }
+    return append(append([]string(nil), t.lines[t.next:]...), t.lines[:t.next]...)
+}
+
+// the transcript as a single text blob, for downloading
+func (t *ProtocolTrace) Bytes() []byte {
+    var buf bytes.Buffer
+    for _, line := range t.Lines() {
+        buf.WriteString(line)
+        buf.WriteString("\n")
+    }
+    return buf.Bytes()
+}
+
+// a connection that records what goes over it in a trace, until stop is
+// called. go-imap reads the greeting as it creates a client, before there
+// is a client to Attach to, so this records it instead.
+type traceConn struct {
+    net.Conn
+    trace   *ProtocolTrace
+    stopped int32
+    // the unfinished last line of each direction
+    in, out []byte
+}
+
+// record conn in the trace until stop. A new connection starts a new
+// session, so nothing is still secret.
+func (t *ProtocolTrace) wrap(conn net.Conn) *traceConn {
+    t.lock.Lock()
+    t.secretTag = ""
+    t.lock.Unlock()
+    return &traceConn{Conn: conn, trace: t}
+}
+
+func (c *traceConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    c.record("S: ", &c.in, p[:n])
+    return n, err
+}
+
+func (c *traceConn) Write(p []byte) (int, error) {
+    n, err := c.Conn.Write(p)
+    c.record("C: ", &c.out, p[:n])
+    return n, err
+}
+
+// stop recording; the client's own logging takes over
+func (c *traceConn) stop() {
+    atomic.StoreInt32(&c.stopped, 1)
+}
+
+// add the complete lines in p to the trace, like go-imap would log them
+func (c *traceConn) record(prefix string, partial *[]byte, p []byte) {
+    if atomic.LoadInt32(&c.stopped) != 0 { return }
+    *partial = append(*partial, p...)
+    for {
+        i := bytes.IndexByte(*partial, '\n')
+        if i < 0 { return }
+        line := strings.TrimRight(string((*partial)[:i]), "\r")
+        *partial = (*partial)[i + 1:]
+        c.trace.Write([]byte(prefix + line))
+    }
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+    "strings"
+    "testing"
+)
+
+// the lines of a trace without their timestamps
+func traceLines(t *ProtocolTrace) []string {
+    lines := t.Lines()
+    for i, line := range lines {
+        lines[i] = line[len("15:04:05.000 "):]
+    }
+    return lines
+}
+
+func TestTraceRedacts(t *testing.T) {
+    tests := []struct {
+        name string
+        in   []string
+        want []string
+    }{
+        {"quoted LOGIN",
+            []string{`C: a1 LOGIN "me" "secret"`, `S: a1 OK done`, `C: a2 NOOP`},
+            []string{`C: a1 LOGIN <redacted>`, `S: a1 OK done`, `C: a2 NOOP`}},
+        {"LOGIN with literals",
+            []string{`C: a1 LOGIN {2}`, `S: + go ahead`, `C: literal 2 bytes`, `C:  {6}`,
+                `S: + go ahead`, `C: secret`, `S: * CAPABILITY IMAP4rev1`, `S: a1 OK done`, `C: a2 NOOP`},
+            []string{`C: a1 LOGIN <redacted>`, `S: + go ahead`, `C: <redacted>`, `C: <redacted>`,
+                `S: + go ahead`, `C: <redacted>`, `S: * CAPABILITY IMAP4rev1`, `S: a1 OK done`, `C: a2 NOOP`}},
+        {"another tag doesn't end it",
+            []string{`C: a1 LOGIN {2}`, `S: a11 OK not ours`, `C: secret`, `S: a1 NO bad password`, `C: a2 NOOP`},
+            []string{`C: a1 LOGIN <redacted>`, `S: a11 OK not ours`, `C: <redacted>`, `S: a1 NO bad password`, `C: a2 NOOP`}},
+        {"AUTHENTICATE",
+            []string{`C: a1 AUTHENTICATE PLAIN`, `S: +`, `C: AG1lAHNlY3JldA==`, `S: a1 OK done`, `C: a2 NOOP`},
+            []string{`C: a1 AUTHENTICATE PLAIN`, `S: +`, `C: <redacted>`, `S: a1 OK done`, `C: a2 NOOP`}},
+        {"AUTHENTICATE with an initial response",
+            []string{`C: a1 authenticate plain AG1lAHNlY3JldA==`, `S: a1 OK done`},
+            []string{`C: a1 authenticate plain <redacted>`, `S: a1 OK done`}},
+    }
+
+    for _, test := range tests {
+        trace := NewProtocolTrace()
+        for _, line := range test.in {
+            trace.Write([]byte(line + "\n"))
+        }
+        got := traceLines(trace)
+        if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+            t.Errorf("%s:\n  got  %q\n  want %q", test.name, got, test.want)
+        }
+    }
+}
+
+func TestTraceRecordsGreeting(t *testing.T) {
+    s, f := listenFakeServer(t, "", nil)
+    defer f.Close()
+    // not ASCII, so go-imap sends it as a literal
+    s.Password = "pässwörd"
+    s.EnableTrace()
+
+    if _, err := s.Connect(); err != nil { t.Fatal(err) }
+    s.Close()
+
+    lines := traceLines(s.Trace)
+    greeting, login := -1, -1
+    for i, line := range lines {
+        if strings.Contains(line, "pässwörd") || strings.Contains(line, `"user"`) {
+            t.Errorf("credentials in the trace: %q", line)
+        }
+        if line == "S: * OK [CAPABILITY IMAP4rev1] ready" {
+            greeting = i
+        }
+        if strings.HasSuffix(line, " LOGIN <redacted>") {
+            login = i
+        }
+    }
+    if greeting < 0 || login < greeting {
+        t.Errorf("greeting at line %d, LOGIN at %d:\n%s", greeting, login, strings.Join(lines, "\n"))
+    }
+    // commands after LOGIN are kept
+    if !strings.Contains(strings.Join(lines[login:], "\n"), " CAPABILITY\n") {
+        t.Errorf("nothing after LOGIN traced:\n%s", strings.Join(lines, "\n"))
+    }
+}
@@ -0,0 +1,112 @@
+package imapsync
+
+import (
+    "github.com/justjake/mail/app/models"
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// an IMAP server on a local port. It logs anyone in, has one mailbox with
+// n messages and UIDVALIDITY 1, records every other command the client
+// sends without its tag, and answers those with whatever reply returns
+// followed by a tagged OK.
+type fakeServer struct {
+    listener net.Listener
+    caps     string
+    n        int
+    reply    func(command string) string
+
+    mu       sync.Mutex
+    commands []string
+}
+
+// a models.Server that connects to a new fakeServer
+func newFakeServer(t *testing.T, caps string, n int, reply func(command string) string) (*models.Server, *fakeServer) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatal(err) }
+    f := &fakeServer{listener: listener, caps: strings.TrimSpace("IMAP4rev1 " + caps), n: n, reply: reply}
+    go f.accept()
+
+    server := models.NewServer(listener.Addr().String(), "user", "password")
+    server.UseTLS = false
+    return server, f
+}
+
+func (f *fakeServer) accept() {
+    for {
+        conn, err := f.listener.Accept()
+        if err != nil { return }
+        go f.serve(conn)
+    }
+}
+
+func (f *fakeServer) serve(conn net.Conn) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    fmt.Fprintf(conn, "* OK [CAPABILITY %s] ready\r\n", f.caps)
+    for {
+        line, err := readCommand(conn, r)
+        if err != nil { return }
+        tag, command := line, ""
+        if i := strings.IndexByte(line, ' '); i >= 0 {
+            tag, command = line[:i], line[i+1:]
+        }
+
+        out := ""
+        switch {
+        case strings.HasPrefix(command, "LOGIN "):
+        case command == "CAPABILITY":
+            out = "* CAPABILITY " + f.caps + "\r\n"
+        case command == "LOGOUT":
+            out = "* BYE\r\n"
+        case strings.HasPrefix(command, "SELECT ") || strings.HasPrefix(command, "EXAMINE "):
+            out = fmt.Sprintf("* %d EXISTS\r\n* OK [UIDVALIDITY 1] ok\r\n* OK [UIDNEXT %d] ok\r\n", f.n, f.n + 1)
+        default:
+            f.mu.Lock()
+            f.commands = append(f.commands, command)
+            f.mu.Unlock()
+            if f.reply != nil {
+                out = f.reply(command)
+            }
+        }
+        fmt.Fprintf(conn, "%s%s OK done\r\n", out, tag)
+    }
+}
+
+// one command line, with any literals in it read inline
+func readCommand(conn net.Conn, r *bufio.Reader) (string, error) {
+    command := ""
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil { return "", err }
+        line = strings.TrimRight(line, "\r\n")
+        command += line
+
+        open := strings.LastIndex(line, "{")
+        if open < 0 || !strings.HasSuffix(line, "}") { return command, nil }
+        n, err := strconv.Atoi(line[open + 1:len(line) - 1])
+        if err != nil { return command, nil }
+
+        fmt.Fprint(conn, "+ go ahead\r\n")
+        literal := make([]byte, n)
+        if _, err := io.ReadFull(r, literal); err != nil { return "", err }
+        command += "\n" + string(literal)
+    }
+}
+
+// the commands, other than logging in and selecting, sent so far
+func (f *fakeServer) Commands() []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return append([]string(nil), f.commands...)
+}
+
+func (f *fakeServer) Close() {
+    f.listener.Close()
+}
@@ -0,0 +1,64 @@
+package imapsync
+
+// translating between IMAP flags and maildir flag letters
+
+import (
+    "github.com/justjake/mail/app/models"
+    "github.com/justjake/mail/maildir"
+    "strings"
+)
+
+// the IMAP keyword most clients use for forwarded messages
+const KeywordForwarded = "$Forwarded"
+
+// maildir flag -> IMAP flag. Other IMAP keywords have no maildir
+// equivalent and are left alone on the server.
+var flagMap = []struct {
+    local  maildir.Flag
+    remote string
+}{
+    {maildir.Draft,   models.FlagDraft},
+    {maildir.Flagged, models.FlagFlagged},
+    {maildir.Passed,  KeywordForwarded},
+    {maildir.Replied, models.FlagAnswered},
+    {maildir.Seen,    models.FlagSeen},
+    {maildir.Trashed, models.FlagDeleted},
+}
+
+// the maildir flags for a list of IMAP flags
+func localFlags(remote []string) maildir.Flag {
+    var flags maildir.Flag
+    for _, f := range remote {
+        for _, m := range flagMap {
+            if strings.EqualFold(f, m.remote) {
+                flags |= m.local
+            }
+        }
+    }
+    return flags
+}
+
+// the IMAP flag for each maildir flag bit in flags
+func remoteFlags(flags maildir.Flag) []string {
+    remote := make([]string, 0)
+    for _, m := range flagMap {
+        if flags & m.local != 0 {
+            remote = append(remote, m.remote)
+        }
+    }
+    return remote
+}
+
+// parse maildir flag letters from the state file
+func parseFlags(letters string) maildir.Flag {
+    return maildir.ReadFlags(maildir.InfoSeparator + letters)
+}
+
+// three-way merge of flags changed on both sides since the last sync.
+// each flag is taken from whichever side changed it; if both changed it,
+// they both changed it the same way. So there are never conflicts, and the
+// result doesn't depend on which side we look at first.
+func mergeFlags(base, local, remote maildir.Flag) maildir.Flag {
+    changedLocally := base ^ local
+    return (local & changedLocally) | (remote &^ changedLocally)
+}
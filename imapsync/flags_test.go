@@ -0,0 +1,48 @@
+package imapsync
+
+import (
+    "github.com/justjake/mail/maildir"
+    "testing"
+)
+
+func TestMergeFlags(t *testing.T) {
+    const S, F, R = maildir.Seen, maildir.Flagged, maildir.Replied
+    tests := []struct {
+        name                string
+        base, local, remote maildir.Flag
+        want                maildir.Flag
+    }{
+        {"nothing changed", S, S, S, S},
+        {"read here", 0, S, 0, S},
+        {"read there", 0, 0, S, S},
+        {"unread here", S, 0, S, 0},
+        {"unread there", S, S, 0, 0},
+        {"both read", 0, S, S, S},
+        {"different flags on each side", S, S | F, S | R, S | F | R},
+        {"one added, the other removed", S | F, F, S | F | R, F | R},
+    }
+
+    for _, test := range tests {
+        if got := mergeFlags(test.base, test.local, test.remote); got != test.want {
+            t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+        }
+        // which side is which mustn't matter
+        if got := mergeFlags(test.base, test.remote, test.local); got != test.want {
+            t.Errorf("%s, sides swapped: got %q, want %q", test.name, got, test.want)
+        }
+    }
+}
+
+func TestFlagTranslation(t *testing.T) {
+    remote := []string{`\Seen`, `\ANSWERED`, `$Forwarded`, `$Label1`}
+    flags := localFlags(remote)
+    if flags.String() != "PRS" {
+        t.Errorf("localFlags(%v) = %q", remote, flags)
+    }
+    if got := remoteFlags(flags); len(got) != 3 {
+        t.Errorf("remoteFlags(%q) = %v", flags, got)
+    }
+    if got := parseFlags("DT"); got != maildir.Draft | maildir.Trashed {
+        t.Errorf(`parseFlags("DT") = %q`, got)
+    }
+}
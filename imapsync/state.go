@@ -0,0 +1,109 @@
+package imapsync
+
+// the state database: what every message looked like the last time we
+// synced it, on both sides. Without it a message missing on one side could
+// be new on the other, or deleted - we couldn't tell.
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    pathlib "path"
+    "strconv"
+)
+
+// name of the state file kept in the sync root
+const StateFile = ".imapsync.json"
+
+// a message as of the last sync
+type Record struct {
+    // maildir unique name (the filename without flags)
+    Key   string
+    // maildir flag letters both sides agreed on
+    Flags string
+}
+
+// the last synced state of one mailbox
+type MailboxState struct {
+    UIDValidity uint32
+    // UID (as a string, for JSON) -> record
+    Messages    map[string]*Record
+    // maildir unique name -> Message-ID of messages we uploaded without
+    // learning their UIDs, and haven't found on the server since
+    Pending     map[string]string
+}
+
+// the last synced state of every mailbox
+type State struct {
+    Mailboxes map[string]*MailboxState
+    path      string
+}
+
+// read the state file in root. A missing file is an empty state.
+func LoadState(root string) (*State, error) {
+    state := &State{
+        Mailboxes: make(map[string]*MailboxState),
+        path: pathlib.Join(root, StateFile),
+    }
+
+    data, err := ioutil.ReadFile(state.path)
+    if os.IsNotExist(err) { return state, nil }
+    if err != nil { return nil, err }
+
+    if err := json.Unmarshal(data, state); err != nil { return nil, err }
+    if state.Mailboxes == nil {
+        state.Mailboxes = make(map[string]*MailboxState)
+    }
+    return state, nil
+}
+
+// write the state file, replacing the old one in one step so a crash
+// can't leave it half written
+func (s *State) Save() error {
+    data, err := json.MarshalIndent(s, "", "  ")
+    if err != nil { return err }
+
+    tmp := s.path + ".tmp"
+    if err := ioutil.WriteFile(tmp, data, 0600); err != nil { return err }
+    return os.Rename(tmp, s.path)
+}
+
+// the state of a mailbox, created empty if we've never synced it
+func (s *State) Mailbox(name string) *MailboxState {
+    box, ok := s.Mailboxes[name]
+    if !ok {
+        box = &MailboxState{Messages: make(map[string]*Record)}
+        s.Mailboxes[name] = box
+    }
+    if box.Messages == nil {
+        box.Messages = make(map[string]*Record)
+    }
+    if box.Pending == nil {
+        box.Pending = make(map[string]string)
+    }
+    return box
+}
+
+func (b *MailboxState) Get(uid uint32) (*Record, bool) {
+    rec, ok := b.Messages[strconv.FormatUint(uint64(uid), 10)]
+    return rec, ok
+}
+
+func (b *MailboxState) Set(uid uint32, rec *Record) {
+    b.Messages[strconv.FormatUint(uint64(uid), 10)] = rec
+}
+
+func (b *MailboxState) Delete(uid uint32) {
+    delete(b.Messages, strconv.FormatUint(uint64(uid), 10))
+}
+
+// every UID we have a record for
+func (b *MailboxState) UIDs() []uint32 {
+    uids := make([]uint32, 0, len(b.Messages))
+    for s := range b.Messages {
+        if uid, err := strconv.ParseUint(s, 10, 32); err == nil {
+            uids = append(uids, uint32(uid))
+        }
+    }
+    return uids
+}
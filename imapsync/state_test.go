@@ -0,0 +1,68 @@
+package imapsync
+
+import (
+    "io/ioutil"
+    "os"
+    pathlib "path"
+    "reflect"
+    "testing"
+)
+
+func TestStateSaveAndLoad(t *testing.T) {
+    root, err := ioutil.TempDir("", "imapsync-test-")
+    if err != nil { t.Fatal(err) }
+    defer os.RemoveAll(root)
+
+    // no state file yet
+    state, err := LoadState(root)
+    if err != nil { t.Fatal(err) }
+    if len(state.Mailboxes) != 0 {
+        t.Errorf("new state has mailboxes: %v", state.Mailboxes)
+    }
+
+    box := state.Mailbox("INBOX")
+    box.UIDValidity = 7
+    box.Set(1, &Record{"one", "S"})
+    box.Set(4000000000, &Record{"big", ""})
+    box.Pending["pending"] = "<a@x>"
+    state.Mailbox("Sent").Set(2, &Record{"two", "RS"})
+    if err := state.Save(); err != nil { t.Fatal(err) }
+
+    info, err := os.Stat(pathlib.Join(root, StateFile))
+    if err != nil { t.Fatal(err) }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("state file mode %v", info.Mode())
+    }
+    if _, err := os.Stat(pathlib.Join(root, StateFile + ".tmp")); !os.IsNotExist(err) {
+        t.Errorf("temporary file left behind: %v", err)
+    }
+
+    loaded, err := LoadState(root)
+    if err != nil { t.Fatal(err) }
+    if !reflect.DeepEqual(loaded.Mailboxes, state.Mailboxes) {
+        t.Errorf("loaded %+v, saved %+v", loaded.Mailboxes, state.Mailboxes)
+    }
+    if rec, ok := loaded.Mailbox("INBOX").Get(4000000000); !ok || rec.Key != "big" {
+        t.Errorf("UID 4000000000 is %v", rec)
+    }
+
+    loaded.Mailbox("INBOX").Delete(1)
+    if uids := loaded.Mailbox("INBOX").UIDs(); len(uids) != 1 || uids[0] != 4000000000 {
+        t.Errorf("UIDs after Delete: %v", uids)
+    }
+}
+
+func TestLoadStateRejectsGarbage(t *testing.T) {
+    root, err := ioutil.TempDir("", "imapsync-test-")
+    if err != nil { t.Fatal(err) }
+    defer os.RemoveAll(root)
+
+    if err := ioutil.WriteFile(pathlib.Join(root, StateFile), []byte("{not json"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    // starting from an empty state would copy every message both ways
+    // again
+    if _, err := LoadState(root); err == nil {
+        t.Error("a broken state file was loaded")
+    }
+}
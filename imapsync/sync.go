@@ -0,0 +1,399 @@
+// Two-way synchronization between the mailboxes on an IMAP server and a
+// directory of maildirs, one per mailbox, in the spirit of offlineimap.
+//
+// New messages, flag changes and deletions on either side are copied to
+// the other. A state file remembers what both sides looked like after the
+// last sync, and conflicts are settled by fixed rules:
+//
+//  - if a mailbox's UIDVALIDITY changed, it isn't synced at all. Our
+//    record of which message is which is worthless, and guessing could
+//    duplicate or delete mail.
+//  - neither is a mailbox whose maildir is missing or empty when the state
+//    says it had messages. That looks like every message was deleted, but
+//    far more likely the folder was moved or lost.
+//  - a mailbox that's skipped or fails doesn't stop the others.
+//  - a message deleted on one side is deleted on the other, even if its
+//    flags changed there in the meantime.
+//  - flags are merged one at a time: each flag takes the value from the
+//    side that changed it. Two sides can't change a flag in different
+//    directions, so this never conflicts.
+//  - new messages on the server that are already marked \Deleted are not
+//    downloaded.
+//  - without UIDPLUS, an uploaded message is kept until a later sync finds
+//    its copy on the server by Message-ID. New local messages without a
+//    Message-ID aren't uploaded to such servers at all.
+package imapsync
+
+import (
+    "github.com/justjake/mail/app/models"
+    "github.com/justjake/mail/maildir"
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "net/mail"
+    "os"
+    pathlib "path"
+    "sort"
+    "strings"
+)
+
+// keeps a server and a directory of maildirs in sync
+type Syncer struct {
+    Server *models.Server
+    // holds one maildir per mailbox, and the state file
+    Root   string
+    State  *State
+}
+
+// what a sync did to one mailbox
+type Report struct {
+    Mailbox       string
+    Downloaded    int
+    Uploaded      int
+    // messages whose flags were changed on each side
+    LocalFlags    int
+    RemoteFlags   int
+    LocalDeleted  int
+    RemoteDeleted int
+    // new local messages left alone, because the server can't tell us
+    // which message is their copy
+    NotUploaded   int
+    // why the mailbox wasn't synced at all, or ""
+    Skipped       string
+    // what stopped the sync part way, or nil. The counts above are what
+    // was done before it.
+    Err           error
+}
+
+// set up syncing a server into root, loading the state of earlier syncs
+func New(server *models.Server, root string) (*Syncer, error) {
+    if err := os.MkdirAll(root, 0700); err != nil { return nil, err }
+    state, err := LoadState(root)
+    if err != nil { return nil, err }
+    return &Syncer{server, root, state}, nil
+}
+
+// the maildir folder name for a mailbox. The hierarchy separator "/"
+// becomes ".", as in Maildir++, so a "." or "%" in a mailbox name is
+// percent-encoded to keep "a/b" and "a.b" apart. A leading "/" is encoded
+// too, so no folder is hidden or clashes with the state file.
+func FolderName(mailbox string) string {
+    name := strings.Replace(mailbox, "%", "%25", -1)
+    name = strings.Replace(name, ".", "%2E", -1)
+    if strings.HasPrefix(name, "/") {
+        name = "%2F" + name[1:]
+    }
+    return strings.Replace(name, "/", ".", -1)
+}
+
+// the mailbox a folder made by FolderName is for
+func MailboxName(folder string) string {
+    name := strings.Replace(folder, ".", "/", -1)
+    name = strings.Replace(name, "%2F", "/", -1)
+    name = strings.Replace(name, "%2E", ".", -1)
+    return strings.Replace(name, "%25", "%", -1)
+}
+
+// sync every mailbox on the server. A mailbox that's skipped or fails
+// doesn't stop the others: there's a Report for every mailbox, and the
+// error lists the ones that weren't fully synced.
+func (s *Syncer) Run() ([]*Report, error) {
+    boxes, err := s.Server.AllMailboxes()
+    if err != nil { return nil, err }
+
+    reports := make([]*Report, 0, len(boxes))
+    problems := make([]string, 0)
+    for _, mbox := range boxes {
+        report, err := s.SyncMailbox(mbox)
+        if report == nil {
+            report = &Report{Mailbox: mbox.Name}
+        }
+        if err != nil {
+            report.Err = err
+            problems = append(problems, fmt.Sprintf("%s: %v", mbox.Name, err))
+        } else if report.Skipped != "" {
+            problems = append(problems, fmt.Sprintf("%s: skipped: %s", mbox.Name, report.Skipped))
+        }
+        reports = append(reports, report)
+    }
+
+    if len(problems) > 0 {
+        return reports, fmt.Errorf("not fully synced: %s", strings.Join(problems, "; "))
+    }
+    return reports, nil
+}
+
+// sync one mailbox with its maildir. The state is saved even if something
+// fails part way, since it only records what was actually done. A mailbox
+// that's not safe to sync comes back with its Report's Skipped set, and
+// nothing done to either side.
+func (s *Syncer) SyncMailbox(mbox *models.Mailbox) (report *Report, err error) {
+    // listing the mailbox also tells us its UIDVALIDITY
+    remote, err := mbox.UIDFlags()
+    if err != nil { return nil, err }
+
+    report = &Report{Mailbox: mbox.Name}
+    state := s.State.Mailbox(mbox.Name)
+    if state.UIDValidity != 0 && state.UIDValidity != mbox.UIDValidity {
+        report.Skipped = fmt.Sprintf("UIDVALIDITY changed from %d to %d; remove %s from %s to sync it again",
+            state.UIDValidity, mbox.UIDValidity, mbox.Name, StateFile)
+        return report, nil
+    }
+
+    // a lost folder would otherwise look like every message was deleted
+    folder := pathlib.Join(s.Root, FolderName(mbox.Name))
+    lost := fmt.Sprintf("%s is missing or empty, but %d messages were synced into it; " +
+        "restore it, or remove %s from %s to download the mailbox again",
+        folder, len(state.Messages), mbox.Name, StateFile)
+    if _, err := os.Stat(folder); os.IsNotExist(err) && len(state.Messages) > 0 {
+        report.Skipped = lost
+        return report, nil
+    }
+
+    dir, err := maildir.CreateDirectory(folder)
+    if err != nil { return nil, err }
+    paths, err := dir.Messages()
+    if err != nil { return nil, err }
+    if len(paths) == 0 && len(state.Messages) > 0 {
+        report.Skipped = lost
+        return report, nil
+    }
+
+    local := make(map[string]string)
+    for _, path := range paths {
+        local[maildir.UniqueName(path)] = path
+    }
+
+    state.UIDValidity = mbox.UIDValidity
+    defer func() {
+        if saveErr := s.State.Save(); err == nil {
+            err = saveErr
+        }
+    }()
+
+    if err := s.syncKnown(mbox, dir, state, local, remote, report); err != nil {
+        return report, err
+    }
+    if err := s.matchPending(mbox, state, local, remote); err != nil {
+        return report, err
+    }
+    if err := s.download(mbox, dir, state, remote, report); err != nil {
+        return report, err
+    }
+    if err := s.upload(mbox, state, local, report); err != nil {
+        return report, err
+    }
+    return report, nil
+}
+
+// bring messages we've synced before up to date: deletions and flags
+func (s *Syncer) syncKnown(mbox *models.Mailbox, dir *maildir.Directory, state *MailboxState,
+                           local map[string]string, remote map[uint32][]string, report *Report) error {
+    expunge := make([]uint32, 0)
+    // flag -> UIDs to add it to or remove it from on the server
+    add := make(map[string][]uint32)
+    remove := make(map[string][]uint32)
+    // flags to record once the server has them
+    merged := make(map[uint32]maildir.Flag)
+
+    uids := state.UIDs()
+    sort.Sort(uidSlice(uids))
+    for _, uid := range uids {
+        rec, _ := state.Get(uid)
+        path, inLocal := local[rec.Key]
+        flags, inRemote := remote[uid]
+        delete(local, rec.Key)
+
+        switch {
+        case !inLocal && !inRemote:
+            state.Delete(uid)
+
+        case !inLocal:
+            expunge = append(expunge, uid)
+
+        case !inRemote:
+            if err := dir.Remove(path); err != nil { return err }
+            state.Delete(uid)
+            report.LocalDeleted++
+
+        default:
+            base := parseFlags(rec.Flags)
+            localNow, remoteNow := maildir.ReadFlags(path), localFlags(flags)
+            result := mergeFlags(base, localNow, remoteNow)
+
+            if result != localNow {
+                if _, err := dir.SetFlags(path, result); err != nil { return err }
+                report.LocalFlags++
+            }
+            if result != remoteNow {
+                for _, flag := range remoteFlags(result &^ remoteNow) {
+                    add[flag] = append(add[flag], uid)
+                }
+                for _, flag := range remoteFlags(remoteNow &^ result) {
+                    remove[flag] = append(remove[flag], uid)
+                }
+                report.RemoteFlags++
+            }
+            merged[uid] = result
+        }
+    }
+
+    for _, flag := range sortedFlags(add) {
+        if err := mbox.AddFlags(add[flag], flag); err != nil { return err }
+    }
+    for _, flag := range sortedFlags(remove) {
+        if err := mbox.RemoveFlags(remove[flag], flag); err != nil { return err }
+    }
+    for uid, flags := range merged {
+        rec, _ := state.Get(uid)
+        rec.Flags = flags.String()
+    }
+
+    if len(expunge) > 0 {
+        if err := mbox.Expunge(expunge); err != nil { return err }
+        for _, uid := range expunge {
+            state.Delete(uid)
+        }
+        report.RemoteDeleted += len(expunge)
+    }
+
+    return nil
+}
+
+// download messages that are new on the server
+func (s *Syncer) download(mbox *models.Mailbox, dir *maildir.Directory, state *MailboxState,
+                          remote map[uint32][]string, report *Report) error {
+    uids := make([]uint32, 0)
+    for uid, flags := range remote {
+        _, known := state.Get(uid)
+        // on its way out, possibly expunged by us without UIDPLUS
+        trashed := localFlags(flags) & maildir.Trashed != 0
+        if !known && !trashed {
+            uids = append(uids, uid)
+        }
+    }
+    sort.Sort(uidSlice(uids))
+
+    // one FETCH for the lot, not a SELECT and FETCH per message
+    return mbox.RawMessages(uids, func(uid uint32, raw []byte) error {
+        flags := localFlags(remote[uid])
+        path, err := dir.Deliver(raw, flags)
+        if err != nil { return err }
+
+        state.Set(uid, &Record{maildir.UniqueName(path), flags.String()})
+        report.Downloaded++
+        return nil
+    })
+}
+
+// find the server's copies of messages we uploaded without learning their
+// UIDs, by Message-ID. Pending messages are taken out of local either way,
+// so they aren't uploaded twice.
+func (s *Syncer) matchPending(mbox *models.Mailbox, state *MailboxState,
+                              local map[string]string, remote map[uint32][]string) error {
+    for _, key := range sortedKeys(state.Pending) {
+        id := state.Pending[key]
+        _, inLocal := local[key]
+        delete(local, key)
+        if id == "" { continue }
+
+        found, err := mbox.Search(models.NewCriteria().Header("Message-ID", id))
+        if err != nil { return err }
+        // the newest copy we don't already know about
+        var uid uint32
+        for _, u := range found.UIDs {
+            _, known := state.Get(u)
+            _, inRemote := remote[u]
+            if !known && inRemote && u > uid {
+                uid = u
+            }
+        }
+
+        switch {
+        case uid != 0:
+            // the server's flags are the base, so anything changed here
+            // since the upload is copied over next time. If ours was
+            // deleted meanwhile, so is the copy.
+            state.Set(uid, &Record{key, localFlags(remote[uid]).String()})
+            delete(state.Pending, key)
+        case !inLocal:
+            // gone here, and not there: nothing left to match
+            delete(state.Pending, key)
+        }
+    }
+    return nil
+}
+
+// upload messages that are new in the maildir. local only holds messages
+// we have no record of by now.
+func (s *Syncer) upload(mbox *models.Mailbox, state *MailboxState,
+                        local map[string]string, report *Report) error {
+    if len(local) == 0 { return nil }
+    c, err := s.Server.Connect()
+    if err != nil { return err }
+    uidplus := c.Caps["UIDPLUS"]
+
+    for _, key := range sortedKeys(local) {
+        path := local[key]
+        raw, err := ioutil.ReadFile(path)
+        if err != nil { return err }
+        info, err := os.Stat(path)
+        if err != nil { return err }
+
+        // without UIDPLUS, the Message-ID is the only way to find our copy
+        // on the server, so there's no point uploading without one
+        id := messageID(raw)
+        if !uidplus && id == "" {
+            report.NotUploaded++
+            continue
+        }
+
+        flags := maildir.ReadFlags(path)
+        uid, err := mbox.Append(bytes.NewReader(raw), remoteFlags(flags), info.ModTime())
+        if err != nil { return err }
+        report.Uploaded++
+
+        if uid == 0 {
+            // we don't know which message is the copy we just made. Keep
+            // ours until a later sync finds it by Message-ID.
+            state.Pending[key] = id
+            continue
+        }
+        state.Set(uid, &Record{key, flags.String()})
+    }
+    return nil
+}
+
+// the Message-ID of a raw message, brackets and all, or ""
+func messageID(raw []byte) string {
+    msg, err := mail.ReadMessage(bytes.NewReader(raw))
+    if err != nil { return "" }
+    return strings.TrimSpace(msg.Header.Get("Message-Id"))
+}
+
+// sorted keys of a map, so syncs happen in a repeatable order
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// the flags in a flag -> UIDs map, sorted
+func sortedFlags(m map[string][]uint32) []string {
+    flags := make([]string, 0, len(m))
+    for flag := range m {
+        flags = append(flags, flag)
+    }
+    sort.Strings(flags)
+    return flags
+}
+
+// sorts UIDs in ascending order
+type uidSlice []uint32
+
+func (p uidSlice) Len() int           { return len(p) }
+func (p uidSlice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uidSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,155 @@
+package imapsync
+
+import (
+    "github.com/justjake/mail/app/models"
+    "github.com/justjake/mail/maildir"
+    "fmt"
+    "io/ioutil"
+    "os"
+    pathlib "path"
+    "strings"
+    "testing"
+)
+
+func TestFolderName(t *testing.T) {
+    tests := []struct {
+        mailbox string
+        folder  string
+    }{
+        {"INBOX", "INBOX"},
+        {"a/b", "a.b"},
+        {"a.b", "a%2Eb"},
+        {"a/b.c", "a.b%2Ec"},
+        {"100%/x", "100%25.x"},
+        {"%2E", "%252E"},
+        {"/rooted", "%2Frooted"},
+        {".hidden", "%2Ehidden"},
+    }
+
+    folders := make(map[string]string)
+    for _, test := range tests {
+        folder := FolderName(test.mailbox)
+        if folder != test.folder {
+            t.Errorf("FolderName(%q) = %q, want %q", test.mailbox, folder, test.folder)
+        }
+        if back := MailboxName(folder); back != test.mailbox {
+            t.Errorf("MailboxName(%q) = %q, want %q", folder, back, test.mailbox)
+        }
+        if other, ok := folders[folder]; ok {
+            t.Errorf("%q and %q both go in %q", other, test.mailbox, folder)
+        }
+        folders[folder] = test.mailbox
+    }
+}
+
+func testMessage(id string) string {
+    return "Message-ID: " + id + "\r\nSubject: test\r\n\r\nbody\r\n"
+}
+
+func TestDownloadFetchesOnce(t *testing.T) {
+    root, err := ioutil.TempDir("", "imapsync-test-")
+    if err != nil { t.Fatal(err) }
+    defer os.RemoveAll(root)
+
+    raw := map[uint32]string{1: testMessage("<1@x>"), 2: testMessage("<2@x>")}
+    server, f := newFakeServer(t, "", 3, func(command string) string {
+        switch {
+        case command == "UID FETCH 1:* (UID FLAGS)":
+            return "* 1 FETCH (UID 1 FLAGS (\\Seen))\r\n" +
+                "* 2 FETCH (UID 2 FLAGS ())\r\n" +
+                "* 3 FETCH (UID 3 FLAGS (\\Deleted))\r\n"
+        case strings.HasPrefix(command, "UID FETCH") && strings.Contains(command, "BODY.PEEK[]"):
+            out := ""
+            for uid := uint32(1); uid <= 2; uid++ {
+                out += fmt.Sprintf("* %d FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", uid, uid, len(raw[uid]), raw[uid])
+            }
+            return out
+        }
+        return ""
+    })
+    defer f.Close()
+    defer server.Close()
+
+    s, err := New(server, root)
+    if err != nil { t.Fatal(err) }
+    report, err := s.SyncMailbox(models.NewMailbox("INBOX", server))
+    if err != nil { t.Fatal(err) }
+    if report.Downloaded != 2 {
+        t.Errorf("downloaded %d messages, want 2", report.Downloaded)
+    }
+
+    fetches := make([]string, 0)
+    for _, command := range f.Commands() {
+        if strings.Contains(command, "BODY.PEEK[]") {
+            fetches = append(fetches, command)
+        }
+    }
+    // the \Deleted message isn't asked for
+    if len(fetches) != 1 || fetches[0] != "UID FETCH 1:2 (UID BODY.PEEK[])" {
+        t.Errorf("fetched bodies with %q", fetches)
+    }
+
+    state := s.State.Mailbox("INBOX")
+    for uid, want := range map[uint32]string{1: "S", 2: ""} {
+        rec, ok := state.Get(uid)
+        if !ok {
+            t.Errorf("no record of UID %d", uid)
+            continue
+        }
+        path := pathlib.Join(root, "INBOX", "cur", rec.Key + maildir.InfoSeparator + want)
+        data, err := ioutil.ReadFile(path)
+        if err != nil {
+            t.Errorf("UID %d: %v", uid, err)
+        } else if string(data) != raw[uid] {
+            t.Errorf("UID %d was delivered as %q", uid, data)
+        }
+    }
+    if _, ok := state.Get(3); ok {
+        t.Error("the \\Deleted message was downloaded")
+    }
+}
+
+func TestMatchPending(t *testing.T) {
+    server, f := newFakeServer(t, "", 6, func(command string) string {
+        switch {
+        case strings.Contains(command, "<a@x>"):
+            // 6 is already synced, so 5 must be our upload
+            return "* SEARCH 5 6\r\n"
+        case strings.HasPrefix(command, "UID SEARCH"):
+            return "* SEARCH\r\n"
+        }
+        return ""
+    })
+    defer f.Close()
+    defer server.Close()
+
+    state := (&State{Mailboxes: make(map[string]*MailboxState)}).Mailbox("INBOX")
+    state.Set(6, &Record{"known", ""})
+    state.Pending["found"] = "<a@x>"
+    state.Pending["not yet"] = "<b@x>"
+    state.Pending["deleted here"] = "<c@x>"
+    state.Pending["no id"] = ""
+    local := map[string]string{
+        "found": "cur/found:2,",
+        "not yet": "cur/not yet:2,",
+        "no id": "cur/no id:2,",
+        "new": "cur/new:2,",
+    }
+    remote := map[uint32][]string{5: {models.FlagSeen}, 6: {}}
+
+    s := &Syncer{Server: server}
+    if err := s.matchPending(models.NewMailbox("INBOX", server), state, local, remote); err != nil {
+        t.Fatal(err)
+    }
+
+    if rec, ok := state.Get(5); !ok || rec.Key != "found" || rec.Flags != "S" {
+        t.Errorf("UID 5 is %+v, want the uploaded message with the server's flags", rec)
+    }
+    if fmt.Sprint(sortedKeys(state.Pending)) != "[no id not yet]" {
+        t.Errorf("still pending: %v", state.Pending)
+    }
+    // only messages we've never uploaded are left to upload
+    if len(local) != 1 || local["new"] == "" {
+        t.Errorf("left to upload: %v", local)
+    }
+}
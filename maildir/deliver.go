@@ -0,0 +1,84 @@
+package maildir
+
+// writing to a maildir: delivering messages, changing their flags and
+// removing them.
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    pathlib "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+// delivery counter, part of the unique filename
+var (
+    deliveries     uint64
+    deliveriesLock sync.Mutex
+)
+
+// create a maildir (with new, cur and tmp) at path if it doesn't exist
+func CreateDirectory(path string) (*Directory, error) {
+    for _, sub := range []string{"new", "cur", "tmp"} {
+        if err := os.MkdirAll(pathlib.Join(path, sub), 0700); err != nil {
+            return nil, err
+        }
+    }
+    return NewDirectory(path)
+}
+
+// a filename no other delivery will use, as described at
+// http://cr.yp.to/proto/maildir.html
+func uniqueName() string {
+    deliveriesLock.Lock()
+    deliveries++
+    count := deliveries
+    deliveriesLock.Unlock()
+
+    host, err := os.Hostname()
+    if err != nil {
+        host = "localhost"
+    }
+    // these would break the filename
+    host = strings.Replace(host, "/", `\057`, -1)
+    host = strings.Replace(host, ":", `\072`, -1)
+
+    now := time.Now()
+    return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+        now.Unix(), now.Nanosecond() / 1000, os.Getpid(), count, host)
+}
+
+// write a message into the maildir with the given flags. It's written to
+// tmp/ first and then moved into cur/, so readers never see part of it.
+// Returns the new message's path.
+func (d Directory) Deliver(raw []byte, flags Flag) (string, error) {
+    name := uniqueName()
+    tmp := pathlib.Join(d.Path, "tmp", name)
+    if err := ioutil.WriteFile(tmp, raw, 0600); err != nil { return "", err }
+
+    path := pathlib.Join(d.Path, "cur", name + InfoSeparator + flags.String())
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return "", err
+    }
+    return path, nil
+}
+
+// change the flags on the message at path. Messages in new/ are moved to
+// cur/, since they've now been seen by a mail client.
+// Returns the message's new path.
+func (d Directory) SetFlags(path string, flags Flag) (string, error) {
+    name := UniqueName(path) + InfoSeparator + flags.String()
+    newPath := pathlib.Join(d.Path, "cur", name)
+    if newPath == path { return path, nil }
+
+    if err := os.Rename(path, newPath); err != nil { return "", err }
+    return newPath, nil
+}
+
+// delete the message at path
+func (d Directory) Remove(path string) error {
+    return os.Remove(path)
+}
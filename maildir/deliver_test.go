@@ -0,0 +1,96 @@
+package maildir
+
+import (
+    "io/ioutil"
+    "os"
+    pathlib "path"
+    "testing"
+)
+
+func TestDeliverAndSetFlags(t *testing.T) {
+    root, err := ioutil.TempDir("", "maildir-test-")
+    if err != nil { t.Fatal(err) }
+    defer os.RemoveAll(root)
+
+    d, err := CreateDirectory(pathlib.Join(root, "INBOX"))
+    if err != nil { t.Fatal(err) }
+
+    raw := []byte("Subject: hi\r\n\r\nhello\r\n")
+    path, err := d.Deliver(raw, Seen | Flagged)
+    if err != nil { t.Fatal(err) }
+    if pathlib.Base(pathlib.Dir(path)) != "cur" {
+        t.Errorf("delivered to %s, want cur/", path)
+    }
+    if got := ReadFlags(path); got != Seen | Flagged {
+        t.Errorf("delivered with flags %q", got)
+    }
+    if data, err := ioutil.ReadFile(path); err != nil || string(data) != string(raw) {
+        t.Errorf("delivered %q, %v", data, err)
+    }
+    if tmp, _ := ioutil.ReadDir(pathlib.Join(d.Path, "tmp")); len(tmp) != 0 {
+        t.Errorf("%d files left in tmp/", len(tmp))
+    }
+
+    // a second delivery never reuses the name
+    other, err := d.Deliver(raw, 0)
+    if err != nil { t.Fatal(err) }
+    if UniqueName(other) == UniqueName(path) {
+        t.Errorf("two deliveries named %s", UniqueName(path))
+    }
+
+    moved, err := d.SetFlags(path, Replied | Seen)
+    if err != nil { t.Fatal(err) }
+    if UniqueName(moved) != UniqueName(path) {
+        t.Errorf("SetFlags renamed %s to %s", path, moved)
+    }
+    if got := ReadFlags(moved); got != Replied | Seen {
+        t.Errorf("flags are %q after SetFlags", got)
+    }
+    if _, err := os.Stat(path); !os.IsNotExist(err) {
+        t.Errorf("old name still there: %v", err)
+    }
+
+    // a message in new/ moves to cur/
+    fresh := pathlib.Join(d.Path, "new", "123.M1P2Q3.host")
+    if err := ioutil.WriteFile(fresh, raw, 0600); err != nil { t.Fatal(err) }
+    seen, err := d.SetFlags(fresh, Seen)
+    if err != nil { t.Fatal(err) }
+    if seen != pathlib.Join(d.Path, "cur", "123.M1P2Q3.host:2,S") {
+        t.Errorf("new message moved to %s", seen)
+    }
+
+    paths, err := d.Messages()
+    if err != nil { t.Fatal(err) }
+    if len(paths) != 3 {
+        t.Errorf("%d messages, want 3", len(paths))
+    }
+}
+
+func TestReadFlags(t *testing.T) {
+    tests := []struct {
+        path string
+        want Flag
+    }{
+        {"cur/123.M1P2Q3.host:2,FS", Flagged | Seen},
+        {"cur/123.M1P2Q3.host:2,", 0},
+        {"new/123.M1P2Q3.host", 0},
+        {"cur/123.M1P2Q3.host:2,DFPRST", Draft | Flagged | Passed | Replied | Seen | Trashed},
+        // unknown letters are ignored, and the order doesn't matter
+        {"cur/123.M1P2Q3.host:2,Sa", Seen},
+        {"cur/123.M1P2Q3.host:2,TD", Trashed | Draft},
+    }
+
+    for _, test := range tests {
+        if got := ReadFlags(test.path); got != test.want {
+            t.Errorf("ReadFlags(%q) = %q, want %q", test.path, got, test.want)
+        }
+    }
+
+    // and written in ASCII order
+    if s := (Trashed | Draft | Seen).String(); s != "DST" {
+        t.Errorf("flags written as %q", s)
+    }
+    if name := UniqueName("cur/123.M1P2Q3.host:2,S"); name != "123.M1P2Q3.host" {
+        t.Errorf("UniqueName is %q", name)
+    }
+}
@@ -0,0 +1,60 @@
+package maildir
+
+// message flags live in the filename, after the ":2," info separator.
+// see http://cr.yp.to/proto/maildir.html
+
+import (
+    "strings"
+    pathlib "path"
+)
+
+// separates the unique part of a filename from its flags
+const InfoSeparator = ":2,"
+
+// flag letters, in the (ASCII) order they must appear in a filename
+var flagLetters = []struct {
+    letter rune
+    flag   Flag
+}{
+    {'D', Draft},
+    {'F', Flagged},
+    {'P', Passed},
+    {'R', Replied},
+    {'S', Seen},
+    {'T', Trashed},
+}
+
+// the flag letters for a set of flags, like "FS"
+func (f Flag) String() string {
+    letters := make([]rune, 0, len(flagLetters))
+    for _, l := range flagLetters {
+        if f & l.flag != 0 {
+            letters = append(letters, l.letter)
+        }
+    }
+    return string(letters)
+}
+
+// read the flags out of a message filename or path.
+// unknown letters are ignored.
+func ReadFlags(path string) Flag {
+    base := pathlib.Base(path)
+    i := strings.LastIndex(base, InfoSeparator)
+    if i < 0 { return 0 }
+
+    var flags Flag
+    for _, c := range base[i + len(InfoSeparator):] {
+        flags |= ReadFlag(c)
+    }
+    return flags
+}
+
+// the unique part of a message filename, which stays the same when its
+// flags change or it moves from new/ to cur/
+func UniqueName(path string) string {
+    base := pathlib.Base(path)
+    if i := strings.LastIndex(base, InfoSeparator); i >= 0 {
+        return base[:i]
+    }
+    return base
+}
@@ -12,6 +12,7 @@ import (
     "io"
     "io/ioutil"
     pathlib  "path" 
+    "strings"
 
     "mime"
     "mime/multipart"
@@ -119,13 +120,20 @@ func (d Directory) Name() string {
 
 // get the paths to every message in the maildir
 func (d Directory) Messages() ([]string, error) {
+    paths := make([]string, 0)
     for _, subdir := range [2]string{"new", "cur"} {
         path := pathlib.Join(d.Path, subdir)
-        _ = path
-        // TODO: finish
+        infos, err := ioutil.ReadDir(path)
+        if err != nil { return nil, err }
+
+        for _, f := range infos {
+            // dotfiles aren't messages
+            if f.IsDir() || strings.HasPrefix(f.Name(), ".") { continue }
+            paths = append(paths, pathlib.Join(path, f.Name()))
+        }
     }
 
-    return nil, fmt.Errorf("Not implemented")
+    return paths, nil
 }
 
 // get the paths to every folder in the maildir
@@ -152,8 +160,6 @@ func LoadMessage(path string) (msg *Message, err error) {
     file, err := os.Open(path)
     if err != nil { return nil, err }
 
-    // TODO: read maildir flags from the filename!
-
     // parse using the nice, pretty standard lib. nice and pretty.
     parsed, err := mail.ReadMessage(file)
     if err != nil { return nil, err }
@@ -161,6 +167,7 @@ func LoadMessage(path string) (msg *Message, err error) {
     // instantiate our personal mail structure
     msg = &Message{
         Path:    path,
+        Flags:   ReadFlags(path),
         Header:  parsed.Header,
         Body:    parsed.Body,
     }
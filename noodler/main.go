@@ -55,9 +55,8 @@ func test_marshalreader() {
     data, err := mr.Data()
     fmt.Printf("MarshalReader basic test: \ndata: %d\nerror: %v\n", data, err)
 
-    newer, backup := models.BackupReader(mr)
-    fmt.Println(newer.Data())
-    fmt.Println(backup.Data())
+    // reading again gets the same data
+    fmt.Println(mr.Data())
 }
 
 
@@ -89,10 +88,10 @@ func main() {
         os.Exit(1)
     }
 
-    msgs, err := spam.Update()
+    page, err := spam.Page(1, 0)
     fatal("update spam", err)
 
-    lastMsg := msgs[ len(msgs) - 1 ]
+    lastMsg := page.Messages[0]
 
     // download and parse body
     _, err = lastMsg.Body(false)
@@ -103,6 +102,7 @@ func main() {
 
     msg_tree, err := lastMsg.ParseBody()
     fatal("parse body", err)
+    defer msg_tree.Close()
 
     ///var recurseNode func(node *models.MessageNode)
     ///recurseNode = func (node *models.MessageNode) {